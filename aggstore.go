@@ -0,0 +1,280 @@
+//
+//  Aggregation store for the bid, win, pixel and click counters.
+//  Counters for all event kinds of a RecordKey are kept together. The keys are
+//  spread over shards, each with its own lock, so the partition consumers can
+//  count concurrently while the ticker collects expired intervals.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventKind - kind of RTB event counted by the store
+type EventKind int
+
+// Event kinds, used to index CountFields.counts
+const (
+	KindBid EventKind = iota
+	KindWin
+	KindPixel
+	KindClick
+	numEventKinds
+)
+
+// Number of shards in the aggregation store. Power of 2.
+const aggShards = 64
+
+// CountFields - stores message counts and time interval of a record key.
+type CountFields struct {
+	counts     [numEventKinds]int64 // Count for each event kind, increments for each occurrence of the bid, win, pixel, click
+	intervalTs int64                // Epoch time in milleseconds timestamp for the interval.
+	intervalTm time.Time            // Time object timestamp for the interval.
+	late       bool                 // Counts of late events for an interval that has been written
+	bidPrice   Micros               // Sum of the bid prices
+	winPrice   Micros               // Sum of the win clearing prices
+	winCost    Micros               // Sum of the win costs
+	bidDomains *HLL                 // Distinct domains bid on, nil until a bid has a domain
+	winDomains *HLL                 // Distinct domains won on, nil until a win has a domain
+	hitters    *heavyHitters        // Top domains and exchanges of the wins, nil until a win or if topN is 0
+
+	dups    [numEventKinds]int64            // Duplicate events, not in counts
+	joined  [numEventKinds]int64            // Events joined to the previous step of their bid id
+	latency [numEventKinds]latencyHistogram // Latency from the previous step of the joined events
+}
+
+// aggShard - subset of the record keys with the lock that protects them
+type aggShard struct {
+	lock   sync.Mutex
+	counts map[RecordKey]*CountFields
+}
+
+// AggStore - sharded map of unique interval keys to counts
+type AggStore struct {
+	shards  [aggShards]*aggShard
+	lock    *sync.RWMutex             // Protects written and emitted
+	written map[string]int64          // Granularity to the latest interval written, epoch milliseconds
+	emitted map[RecordKey]CountFields // Records written within the late horizon, for the reemit policy
+}
+
+// Instantiate the aggregation store
+var aggStore = newAggStore()
+
+func newAggStore() *AggStore {
+	s := &AggStore{
+		lock:    new(sync.RWMutex),
+		written: make(map[string]int64),
+		emitted: make(map[RecordKey]CountFields),
+	}
+	for i := range s.shards {
+		s.shards[i] = &aggShard{counts: make(map[RecordKey]*CountFields)}
+	}
+	return s
+}
+
+// Select the shard for a key. The dimensions spread the keys, the interval does not need to.
+func (s *AggStore) shard(key RecordKey) *aggShard {
+	h := uint64(key.CampaignID)*0x9E3779B97F4A7C15 ^ uint64(key.CreativeID)*0xC2B2AE3D27D4EB4F
+	// FNV-1a of the string dimensions, for the sets without campaign or creative
+	for _, dim := range [...]string{key.Creative, key.Exchange, key.Domain, key.AdType} {
+		for i := 0; i < len(dim); i++ {
+			h ^= uint64(dim[i])
+			h *= 1099511628211
+		}
+	}
+	h ^= h >> 29
+	return s.shards[h&(aggShards-1)]
+}
+
+// Increment the counter of an event kind for the key and add its amounts.
+// late is set if the interval has been written.
+func (s *AggStore) add(kind EventKind, key RecordKey, field EventFields, tsMs int64, tm time.Time, late bool) {
+	sh := s.shard(key)
+	sh.lock.Lock()
+	fields, ok := sh.counts[key]
+	if !ok {
+		// Doesn't exists so initialize
+		fields = &CountFields{intervalTs: tsMs, intervalTm: tm, late: late}
+		sh.counts[key] = fields
+	}
+	if field.Duplicate {
+		fields.dups[kind]++
+		sh.lock.Unlock()
+		return
+	}
+	fields.counts[kind]++
+	if field.Joined {
+		fields.joined[kind]++
+		fields.latency[kind].add(field.LatencyMs)
+	}
+	switch kind {
+	case KindBid:
+		fields.bidPrice += field.Price
+		if field.Domain != "" {
+			if fields.bidDomains == nil {
+				fields.bidDomains = newHLL()
+			}
+			fields.bidDomains.Add(field.Domain)
+		}
+	case KindWin:
+		fields.winPrice += field.Price
+		fields.winCost += field.Cost
+		if field.Domain != "" {
+			if fields.winDomains == nil {
+				fields.winDomains = newHLL()
+			}
+			fields.winDomains.Add(field.Domain)
+		}
+		if topN > 0 {
+			if fields.hitters == nil {
+				fields.hitters = newHeavyHitters(topN)
+			}
+			fields.hitters.addWin(field)
+		}
+	}
+	sh.lock.Unlock()
+}
+
+// Add the counts and amounts of another record of the same key
+func (f *CountFields) merge(o CountFields) {
+	for kind := range f.counts {
+		f.counts[kind] += o.counts[kind]
+		f.dups[kind] += o.dups[kind]
+		f.joined[kind] += o.joined[kind]
+		f.latency[kind].merge(o.latency[kind])
+	}
+	f.bidPrice += o.bidPrice
+	f.winPrice += o.winPrice
+	f.winCost += o.winCost
+	f.bidDomains = mergeHLL(f.bidDomains, o.bidDomains)
+	f.winDomains = mergeHLL(f.winDomains, o.winDomains)
+	f.hitters = mergeHeavyHitters(f.hitters, o.hitters)
+}
+
+// Remove and return the counters of the granularity whose interval is at or before tsMs,
+// or all counters if sendAll. An empty intervalStr is every granularity.
+func (s *AggStore) collect(intervalStr string, tsMs int64, sendAll bool) map[RecordKey]CountFields {
+	records := make(map[RecordKey]CountFields)
+	for _, sh := range s.shards {
+		sh.lock.Lock()
+		for k, fields := range sh.counts {
+			if intervalStr != "" && k.IntervalStr != intervalStr {
+				continue
+			}
+			if sendAll || (fields.intervalTs <= tsMs) {
+				records[k] = *fields
+				delete(sh.counts, k)
+			}
+		}
+		sh.lock.Unlock()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if written, found := s.written[intervalStr]; intervalStr != "" && !sendAll && (!found || tsMs > written) {
+		s.written[intervalStr] = tsMs
+	}
+	if lateData.Policy == LateReemit {
+		s.reemit(records)
+	}
+	return records
+}
+
+// Latest interval of the granularity written, epoch milliseconds. found is false if none has been.
+func (s *AggStore) writtenTo(intervalStr string) (tsMs int64, found bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	tsMs, found = s.written[intervalStr]
+	return tsMs, found
+}
+
+// Check if the interval of the granularity has been written, and if so whether late events
+// for it are still counted.
+func (s *AggStore) lateInterval(intervalStr string, tsMs int64) (late bool, counted bool) {
+	s.lock.RLock()
+	written, found := s.written[intervalStr]
+	s.lock.RUnlock()
+	if !found || tsMs > written {
+		return false, true
+	}
+	return true, lateData.Policy != LateDrop && tsMs > written-int64(lateData.Horizon/time.Millisecond)
+}
+
+// Add the counts already written to the late records, so they are written in full again.
+// Records are kept until their interval is past the late horizon. Called with the lock held.
+func (s *AggStore) reemit(records map[RecordKey]CountFields) {
+	for k, fields := range records {
+		if prev, found := s.emitted[k]; found {
+			fields.merge(prev)
+			records[k] = fields
+		}
+		s.emitted[k] = fields
+	}
+	horizon := int64(lateData.Horizon / time.Millisecond)
+	for k, fields := range s.emitted {
+		if written, found := s.written[k.IntervalStr]; found && fields.intervalTs <= written-horizon {
+			delete(s.emitted, k)
+		}
+	}
+}
+
+// Parse the aggregation intervals, ie 30s, 5m, 1h or 1d. Intervals must divide a day evenly
+// so every interval starts at the same time each day.
+func parseGranularities(specs []string) ([]Granularity, error) {
+	result := []Granularity{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		secs, err := parseIntervalSecs(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range result {
+			if g.IntervalSecs == secs {
+				return nil, fmt.Errorf("Interval %q is configured twice", spec)
+			}
+		}
+		result = append(result, Granularity{IntervalStr: spec, IntervalSecs: secs})
+	}
+	if len(result) == 0 {
+		return nil, errors.New("No aggregation intervals configured")
+	}
+	return result, nil
+}
+
+// The granularity with the shortest interval
+func finestGranularity(gs []Granularity) Granularity {
+	finest := gs[0]
+	for _, g := range gs[1:] {
+		if g.IntervalSecs < finest.IntervalSecs {
+			finest = g
+		}
+	}
+	return finest
+}
+
+// Parse an interval, ie 30s, 5m, 1h or 1d, to seconds. The interval must divide a day evenly.
+func parseIntervalSecs(spec string) (int64, error) {
+	units := map[byte]int64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400}
+	if spec == "" {
+		return 0, errors.New("Empty interval")
+	}
+	unit, found := units[spec[len(spec)-1]]
+	n, err := strconv.ParseInt(spec[:len(spec)-1], 10, 64)
+	if !found || err != nil || n <= 0 {
+		return 0, fmt.Errorf("Bad interval %q, expected a number of s, m, h or d", spec)
+	}
+	secs := n * unit
+	if secs < 86400 && 86400%secs != 0 || secs > 86400 && secs%86400 != 0 {
+		return 0, fmt.Errorf("Interval %q does not divide a day evenly", spec)
+	}
+	return secs, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/go-ozzo/ozzo-log"
+)
+
+func TestMain(m *testing.M) {
+	logger = log.NewLogger()
+	logger.MaxLevel = log.LevelEmergency
+	logger.Open()
+	code := m.Run()
+	logger.Close()
+	os.Exit(code)
+}
+
+// Base event time of the tests, on a day boundary
+const testBaseMs = int64(1700006400000)
+
+// Count events from several partitions while the intervals are collected, with late events
+// corrected so every event ends up in a collected record. Run with -race.
+func TestAggStoreConcurrentAddCollect(t *testing.T) {
+	defer func(l LateData) { lateData = l }(lateData)
+	lateData = LateData{Policy: LateDelta, Horizon: 24 * time.Hour}
+	store := newAggStore()
+
+	const partitions, perPartition, intervals = 8, 2000, 10
+	var wg sync.WaitGroup
+	for p := 0; p < partitions; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perPartition; i++ {
+				store.addFields(KindBid, EventFields{
+					CampaignID: int64(i % 7),
+					CreativeID: int64(p),
+					Price:      1000,
+					Timestamp:  testBaseMs + int64(i%intervals)*300000 + int64(i),
+				})
+			}
+		}(p)
+	}
+
+	var total int64
+	var price Micros
+	sum := func(records map[RecordKey]CountFields) {
+		for _, fields := range records {
+			total += fields.counts[KindBid]
+			price += fields.bidPrice
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for i := int64(0); ; i = (i + 1) % intervals {
+		select {
+		case <-done:
+			sum(store.collect("", 0, true))
+			if want := int64(partitions * perPartition); total != want {
+				t.Fatalf("Counted %d bids, want %d", total, want)
+			}
+			if want := Micros(partitions * perPartition * 1000); price != want {
+				t.Fatalf("Bid price %s, want %s", price, want)
+			}
+			return
+		default:
+			sum(store.collect("5m", testBaseMs+i*300000, false))
+			store.snapshot()
+		}
+	}
+}
+
+// Throughput of counting events from concurrent partitions
+func BenchmarkAggStoreAdd(b *testing.B) {
+	for _, partitions := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("partitions=%d", partitions), func(b *testing.B) {
+			store := newAggStore()
+			perPartition := b.N/partitions + 1
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for p := 0; p < partitions; p++ {
+				wg.Add(1)
+				go func(p int) {
+					defer wg.Done()
+					for i := 0; i < perPartition; i++ {
+						store.addFields(KindBid, EventFields{
+							CampaignID: int64(i % 1000),
+							CreativeID: int64(p),
+							Price:      1000,
+							Timestamp:  testBaseMs + int64(i%300000),
+						})
+					}
+				}(p)
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,40 @@
+//
+//  Alerts - threshold crossings and anomalies raised while consuming.
+//  Alerts are logged, and sent to the alert sink (Kafka topic or local file) if configured.
+//
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Alert - a condition of a campaign that needs attention
+type Alert struct {
+	Type       string    `json:"type"` // What raised the alert, pacing or anomaly
+	CampaignID int64     `json:"campaignId"`
+	CreativeID int64     `json:"creativeId,omitempty"`
+	Metric     string    `json:"metric"`
+	Value      float64   `json:"value"`
+	Threshold  float64   `json:"threshold"`
+	Score      float64   `json:"score,omitempty"`    // Deviations from the baseline, for anomalies
+	Baseline   float64   `json:"baseline,omitempty"` // Baseline mean, for anomalies
+	Message    string    `json:"message"`
+	RaisedAt   time.Time `json:"raisedAt"`
+}
+
+// Alert sink, nil if alerts are only logged
+var alertSink JSONSink
+
+// Raise an alert. It is logged and sent to the alert sink.
+func raiseAlert(alert Alert) {
+	log1 := logger.GetLogger("raiseAlert")
+	log1.Warning(fmt.Sprintf("Alert %s campaign %d: %s", alert.Type, alert.CampaignID, alert.Message))
+	if alertSink == nil {
+		return
+	}
+	if err := alertSink.Send(fmt.Sprintf("%d", alert.CampaignID), alert); err != nil {
+		log1.Error(fmt.Sprintf("Alert not sent (%s): %s", err, alert.Message))
+	}
+}
@@ -0,0 +1,242 @@
+//
+//  Traffic anomaly detection on the aggregation records.
+//  Each record's counts and rates are compared to a rolling baseline (exponentially weighted
+//  mean and variance) of the same record key, campaign/creative and whatever other dimensions
+//  the set has. A record key with a baseline but no record in an interval is seen as zero, so a
+//  campaign that stops receiving bids is caught. Values more than the threshold standard
+//  deviations from the baseline raise an anomaly alert with the score and baseline.
+//
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// anomalyMetric - a value of a record watched for anomalies
+type anomalyMetric struct {
+	name  string
+	rate  bool                                 // A ratio, floors the deviation at minRateDeviation
+	value func(rec AggCounter) (float64, bool) // False if the value is undefined, ie a rate of zero events
+}
+
+// Metrics watched for anomalies
+var anomalyMetrics = []anomalyMetric{
+	{"bids", false, func(rec AggCounter) (float64, bool) { return float64(rec.Bids), true }},
+	{"wins", false, func(rec AggCounter) (float64, bool) { return float64(rec.Wins), true }},
+	{"clicks", false, func(rec AggCounter) (float64, bool) { return float64(rec.Clicks), true }},
+	{"winRate", true, func(rec AggCounter) (float64, bool) { return rate(rec.Wins, rec.Bids), rec.Bids > 0 }},
+	{"clickRate", true, func(rec AggCounter) (float64, bool) { return rate(rec.Clicks, rec.Pixels), rec.Pixels > 0 }},
+}
+
+// Smallest deviation of the baselines, so a steady baseline doesn't make any change an anomaly
+const (
+	minCountDeviation = 1.0
+	minRateDeviation  = 0.01
+)
+
+// Intervals without a record after which a baseline is dropped, ie the campaign was paused
+const anomalyMaxMissing = 12
+
+// anomalyKey - record key of a baseline, without the interval timestamp
+type anomalyKey struct {
+	Interval   string
+	Dimensions string
+	CampaignID int64
+	CreativeID int64
+	Creative   string
+	Exchange   string
+	Domain     string
+	AdType     string
+}
+
+// baseline - exponentially weighted mean and variance of a metric
+type baseline struct {
+	mean     float64
+	variance float64
+	samples  int64
+}
+
+// keyBaselines - baselines of the metrics of a record key
+type keyBaselines struct {
+	metrics map[string]*baseline
+	lastTs  int64 // Latest interval observed, epoch milliseconds
+	missing int   // Consecutive intervals without a record
+}
+
+// AnomalyDetector - baselines of the record keys
+type AnomalyDetector struct {
+	lock       *sync.Mutex
+	keys       map[anomalyKey]*keyBaselines
+	alpha      float64 // Weight of a new value in the baseline
+	threshold  float64 // Standard deviations from the baseline that are an anomaly. 0 disables detection.
+	warmup     int64   // Values in a baseline before it is used
+	maxMissing int     // Baselines are dropped after this many intervals without a record
+}
+
+// Instantiate the anomaly detector, disabled unless configured
+var anomalies = newAnomalyDetector(0.1, 0, 12, anomalyMaxMissing)
+
+func newAnomalyDetector(alpha float64, threshold float64, warmup int64, maxMissing int) *AnomalyDetector {
+	return &AnomalyDetector{
+		lock:       new(sync.Mutex),
+		keys:       make(map[anomalyKey]*keyBaselines),
+		alpha:      alpha,
+		threshold:  threshold,
+		warmup:     warmup,
+		maxMissing: maxMissing,
+	}
+}
+
+func recordAnomalyKey(rec AggCounter) anomalyKey {
+	return anomalyKey{
+		Interval:   rec.Interval,
+		Dimensions: rec.Dimensions,
+		CampaignID: rec.CampaignID,
+		CreativeID: rec.CreativeID,
+		Creative:   rec.CreativeType,
+		Exchange:   rec.Exchange,
+		Domain:     rec.Domain,
+		AdType:     rec.AdType,
+	}
+}
+
+// Score a value against the baseline, then add it. Returns the score and the baseline mean
+// before the value was added, and false while the baseline is warming up.
+func (b *baseline) observe(value float64, alpha float64, warmup int64, minDeviation float64) (float64, float64, bool) {
+	mean := b.mean
+	score, ready := 0.0, b.samples >= warmup
+	if ready {
+		score = (value - b.mean) / math.Max(math.Sqrt(b.variance), minDeviation)
+	}
+	if b.samples == 0 {
+		b.mean = value
+	} else {
+		diff := value - b.mean
+		incr := alpha * diff
+		b.mean += incr
+		b.variance = (1 - alpha) * (b.variance + diff*incr)
+	}
+	b.samples++
+	return score, mean, ready
+}
+
+// Observe the records written for intervals. Correction records are skipped, they are partial.
+func (d *AnomalyDetector) observe(records []AggCounter) {
+	if d.threshold <= 0 {
+		return
+	}
+	// Records of each granularity and dimension set by interval
+	type batchKey struct {
+		interval   string
+		dimensions string
+		ts         int64
+	}
+	batches := make(map[batchKey]map[anomalyKey]AggCounter)
+	for _, rec := range records {
+		if rec.Correction != "" {
+			continue
+		}
+		bk := batchKey{rec.Interval, rec.Dimensions, timeMs(rec.Timestamp)}
+		if batches[bk] == nil {
+			batches[bk] = make(map[anomalyKey]AggCounter)
+		}
+		batches[bk][recordAnomalyKey(rec)] = rec
+	}
+	order := make([]batchKey, 0, len(batches))
+	for bk := range batches {
+		order = append(order, bk)
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i].ts < order[j].ts })
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, bk := range order {
+		batch := batches[bk]
+		// Keys with a baseline but no record in the interval are zero
+		for k, kb := range d.keys {
+			if k.Interval != bk.interval || k.Dimensions != bk.dimensions || kb.lastTs >= bk.ts {
+				continue
+			}
+			if _, found := batch[k]; !found {
+				kb.missing++
+				if kb.missing > d.maxMissing {
+					delete(d.keys, k)
+					continue
+				}
+				d.observeRecord(kb, AggCounter{
+					Dimensions:   k.Dimensions,
+					CampaignID:   k.CampaignID,
+					CreativeID:   k.CreativeID,
+					CreativeType: k.Creative,
+					Exchange:     k.Exchange,
+					Domain:       k.Domain,
+					AdType:       k.AdType,
+					Interval:     k.Interval,
+					Timestamp:    time.Unix(0, bk.ts*int64(time.Millisecond)),
+				}, bk.ts)
+			}
+		}
+		for k, rec := range batch {
+			kb, found := d.keys[k]
+			if !found {
+				kb = &keyBaselines{metrics: make(map[string]*baseline)}
+				d.keys[k] = kb
+			}
+			kb.missing = 0
+			d.observeRecord(kb, rec, bk.ts)
+		}
+	}
+}
+
+// Score the metrics of a record and add them to the baselines. Called with the lock held.
+func (d *AnomalyDetector) observeRecord(kb *keyBaselines, rec AggCounter, tsMs int64) {
+	kb.lastTs = tsMs
+	for _, m := range anomalyMetrics {
+		value, defined := m.value(rec)
+		if !defined {
+			continue
+		}
+		b, found := kb.metrics[m.name]
+		if !found {
+			b = &baseline{}
+			kb.metrics[m.name] = b
+		}
+		minDeviation := minCountDeviation
+		if m.rate {
+			minDeviation = minRateDeviation
+		}
+		score, mean, ready := b.observe(value, d.alpha, d.warmup, minDeviation)
+		if !ready || math.Abs(score) < d.threshold {
+			continue
+		}
+		raiseAlert(Alert{
+			Type:       "anomaly",
+			CampaignID: rec.CampaignID,
+			CreativeID: rec.CreativeID,
+			Metric:     m.name,
+			Value:      value,
+			Threshold:  d.threshold,
+			Score:      score,
+			Baseline:   mean,
+			Message: fmt.Sprintf("%s %s at %s: %s %.4g is %.1f deviations from the baseline %.4g",
+				rec.Interval, recordDimensions(rec), rec.Timestamp.UTC().Format(time.RFC3339), m.name, value, score, mean),
+			RaisedAt: time.Now().UTC(),
+		})
+	}
+}
+
+// Campaign, creative and other dimensions of a record, for messages
+func recordDimensions(rec AggCounter) string {
+	s := ""
+	for _, v := range []string{rec.Exchange, rec.Domain, rec.AdType} {
+		if v != "" {
+			s += " " + v
+		}
+	}
+	return fmt.Sprintf("campaign %d creative %d%s", rec.CampaignID, rec.CreativeID, s)
+}
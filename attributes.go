@@ -0,0 +1,77 @@
+//
+//  Campaign and creative attributes copied from the campaign records into the aggregation
+//  records, as selected by --attributes. Region and the creative type are always written.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Attribute names, as in the JSON of the records
+var attributeNames = []string{"campaignName", "adDomain", "campaignStatus", "campaignStart", "campaignEnd",
+	"creativeName", "width", "height", "videoDuration", "creativeBidPrice"}
+
+// Attributes copied into the records, none unless configured
+var recordAttributes = map[string]bool{}
+
+// Parse the attribute names, ie campaignName,width,height. Names are not case sensitive.
+func parseRecordAttributes(specs []string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		found := false
+		for _, name := range attributeNames {
+			if strings.EqualFold(name, spec) {
+				if result[name] {
+					return nil, fmt.Errorf("Attribute %q is repeated", spec)
+				}
+				result[name] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown attribute %q, expected one of %s", spec, strings.Join(attributeNames, ", "))
+		}
+	}
+	return result, nil
+}
+
+// Copy the selected attributes of the campaign and creative into the record
+func (aggrec *AggCounter) setAttributes(c CampaignCreativeFields) {
+	if recordAttributes["campaignName"] {
+		aggrec.CampaignName = c.CampaignName
+	}
+	if recordAttributes["adDomain"] {
+		aggrec.AdDomain = c.AdDomain
+	}
+	if recordAttributes["campaignStatus"] {
+		aggrec.CampaignStatus = c.CampaignStatus
+	}
+	if recordAttributes["campaignStart"] {
+		aggrec.CampaignStart = c.CampaignStart
+	}
+	if recordAttributes["campaignEnd"] {
+		aggrec.CampaignEnd = c.CampaignEnd
+	}
+	if recordAttributes["creativeName"] {
+		aggrec.CreativeName = c.CreativeName
+	}
+	if recordAttributes["width"] {
+		aggrec.Width = c.Width
+	}
+	if recordAttributes["height"] {
+		aggrec.Height = c.Height
+	}
+	if recordAttributes["videoDuration"] {
+		aggrec.VideoDuration = c.VideoDuration
+	}
+	if recordAttributes["creativeBidPrice"] {
+		aggrec.CreativeBidPrice = c.BidPrice
+	}
+}
@@ -0,0 +1,305 @@
+//
+//  Checkpoints of the aggregation state. The counters of the intervals not yet written are
+//  saved periodically to a local file with the last offset counted from each partition, and
+//  restored on startup. The event source resumes from the offsets acknowledged, which are
+//  behind the checkpoint, so events up to the checkpoint offsets are already in the restored
+//  counters: they are tracked for acknowledgement but not counted again. The campaign spend
+//  of the pacing monitor is saved with the counters, so it carries over restarts too.
+//  Partitions are expected to come back to the same consumer, as with a single consumer.
+//
+
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Version of the checkpoint file
+const checkpointVersion = 1
+
+// Checkpoint - snapshot of the aggregation state and the offsets counted into it
+type Checkpoint struct {
+	Version int
+	SavedAt time.Time
+	Records []CheckpointRecord
+	Written map[string]int64 // Granularity to the latest interval written
+	Offsets []CheckpointOffset
+	Spend   []CheckpointSpend
+}
+
+// CheckpointOffset - last offset counted from a partition
+type CheckpointOffset struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+// CheckpointSpend - win costs of a campaign, and the alerts raised for its current periods
+type CheckpointSpend struct {
+	CampaignID int64
+	Total      Micros
+	DayMs      int64
+	DaySpent   Micros
+	HourMs     int64
+	HourSpent  Micros
+	Alerted    []string
+}
+
+// CheckpointRecord - counters of a record key
+type CheckpointRecord struct {
+	Key        RecordKey
+	Emitted    bool // Written within the late horizon, kept for the reemit policy
+	IntervalTs int64
+	IntervalTm time.Time
+	Late       bool
+	Counts     [numEventKinds]int64
+	Dups       [numEventKinds]int64
+	Joined     [numEventKinds]int64
+	Latency    [numEventKinds]CheckpointLatency
+	BidPrice   Micros
+	WinPrice   Micros
+	WinCost    Micros
+	BidDomains *HLL
+	WinDomains *HLL
+
+	// Heavy hitters, nil if none
+	DomainWins    *TopK
+	DomainSpend   *TopK
+	ExchangeWins  *TopK
+	ExchangeSpend *TopK
+}
+
+// CheckpointLatency - latency histogram of a record
+type CheckpointLatency struct {
+	Buckets [12]int64
+	SumMs   int64
+	MaxMs   int64
+}
+
+// Checkpointer - saves the checkpoints and tracks the offsets restored from one
+type Checkpointer struct {
+	path     string                // Checkpoint file, checkpoints are disabled if empty
+	restored map[PartitionID]int64 // Last offset counted in the restored state. Read only once consuming.
+}
+
+// Instantiate the checkpointer, disabled unless configured
+var checkpoints = newCheckpointer("")
+
+func newCheckpointer(path string) *Checkpointer {
+	return &Checkpointer{path: path, restored: make(map[PartitionID]int64)}
+}
+
+// Check if checkpoints are saved
+func (c *Checkpointer) enabled() bool {
+	return c.path != ""
+}
+
+// Save the aggregation state and offsets. Counting stops while the state is copied.
+func (c *Checkpointer) save() error {
+	flushLock.Lock()
+	cp := c.capture()
+	flushLock.Unlock()
+	return c.write(cp)
+}
+
+// Copy the aggregation state and offsets for a checkpoint, nil if checkpoints are disabled.
+// Called with the flushLock held, so the state and offsets match.
+func (c *Checkpointer) capture() *Checkpoint {
+	if !c.enabled() {
+		return nil
+	}
+	cp := &Checkpoint{Version: checkpointVersion, SavedAt: time.Now().UTC()}
+	cp.Records, cp.Written = aggStore.snapshot()
+	cp.Spend = pacing.snapshot()
+	offsets := offsetTracker.lastOffsets()
+
+	// Offsets of restored partitions not read up to the checkpoint again yet
+	for id, offset := range c.restored {
+		if last, found := offsets[id]; !found || offset > last {
+			offsets[id] = offset
+		}
+	}
+	for id, offset := range offsets {
+		cp.Offsets = append(cp.Offsets, CheckpointOffset{id.Topic, id.Partition, offset})
+	}
+	return cp
+}
+
+// Write a captured checkpoint to the file, replacing the previous one. Nothing to write if nil.
+func (c *Checkpointer) write(cp *Checkpoint) error {
+	if cp == nil {
+		return nil
+	}
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(cp); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Restore the aggregation state from the checkpoint file, if there is one
+func (c *Checkpointer) restore() error {
+	log1 := logger.GetLogger("Checkpointer restore")
+	if !c.enabled() {
+		return nil
+	}
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	cp := Checkpoint{}
+	if err := gob.NewDecoder(f).Decode(&cp); err != nil {
+		return fmt.Errorf("Checkpoint %s: %s", c.path, err)
+	}
+	if cp.Version != checkpointVersion {
+		return fmt.Errorf("Checkpoint %s has unknown version %d", c.path, cp.Version)
+	}
+	aggStore.restore(cp.Records, cp.Written)
+	pacing.restore(cp.Spend)
+	for _, o := range cp.Offsets {
+		c.restored[PartitionID{o.Topic, o.Partition}] = o.Offset
+	}
+	log1.Info(fmt.Sprintf("Restored %d records, %d campaign spends and %d partition offsets from checkpoint of %s.", len(cp.Records), len(cp.Spend), len(cp.Offsets), cp.SavedAt.Format(time.RFC3339)))
+	return nil
+}
+
+// Check if an event is already counted in the restored state
+func (c *Checkpointer) counted(ev Event) bool {
+	offset, found := c.restored[PartitionID{ev.Topic, ev.Partition}]
+	return found && ev.Offset <= offset
+}
+
+// Interval timestamps of an event counted in the restored state, by granularity.
+// The intervals may have been written since, their offsets are released on the next flush.
+func restoredIntervals(field EventFields) []int64 {
+	intervals := make([]int64, len(granularities))
+	for i, g := range granularities {
+		_, intervals[i], _ = intervalTimestamp(field.Timestamp, g.IntervalSecs)
+	}
+	return intervals
+}
+
+// Copy the counters of the store, and the records kept for reemit, for a checkpoint
+func (s *AggStore) snapshot() ([]CheckpointRecord, map[string]int64) {
+	records := []CheckpointRecord{}
+	for _, sh := range s.shards {
+		sh.lock.Lock()
+		for k, fields := range sh.counts {
+			records = append(records, checkpointRecord(k, *fields, false))
+		}
+		sh.lock.Unlock()
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for k, fields := range s.emitted {
+		records = append(records, checkpointRecord(k, fields, true))
+	}
+	written := make(map[string]int64, len(s.written))
+	for g, tsMs := range s.written {
+		written[g] = tsMs
+	}
+	return records, written
+}
+
+// Restore the counters of a checkpoint into the store
+func (s *AggStore) restore(records []CheckpointRecord, written map[string]int64) {
+	for _, rec := range records {
+		fields := rec.countFields()
+		if rec.Emitted {
+			s.lock.Lock()
+			s.emitted[rec.Key] = fields
+			s.lock.Unlock()
+			continue
+		}
+		sh := s.shard(rec.Key)
+		sh.lock.Lock()
+		if prev, found := sh.counts[rec.Key]; found {
+			prev.merge(fields)
+		} else {
+			sh.counts[rec.Key] = &fields
+		}
+		sh.lock.Unlock()
+	}
+	s.lock.Lock()
+	for g, tsMs := range written {
+		if prev, found := s.written[g]; !found || tsMs > prev {
+			s.written[g] = tsMs
+		}
+	}
+	s.lock.Unlock()
+}
+
+func checkpointRecord(k RecordKey, f CountFields, emitted bool) CheckpointRecord {
+	rec := CheckpointRecord{
+		Key:        k,
+		Emitted:    emitted,
+		IntervalTs: f.intervalTs,
+		IntervalTm: f.intervalTm,
+		Late:       f.late,
+		Counts:     f.counts,
+		Dups:       f.dups,
+		Joined:     f.joined,
+		BidPrice:   f.bidPrice,
+		WinPrice:   f.winPrice,
+		WinCost:    f.winCost,
+		BidDomains: f.bidDomains.clone(), // Counting goes on while the checkpoint is encoded
+		WinDomains: f.winDomains.clone(),
+	}
+	for kind, h := range f.latency {
+		rec.Latency[kind] = CheckpointLatency{Buckets: h.buckets, SumMs: h.sumMs, MaxMs: h.maxMs}
+	}
+	if h := f.hitters; h != nil {
+		rec.DomainWins = h.domainWins.clone()
+		rec.DomainSpend = h.domainSpend.clone()
+		rec.ExchangeWins = h.exchangeWins.clone()
+		rec.ExchangeSpend = h.exchangeSpend.clone()
+	}
+	return rec
+}
+
+// Counters of a checkpoint record
+func (rec CheckpointRecord) countFields() CountFields {
+	f := CountFields{
+		intervalTs: rec.IntervalTs,
+		intervalTm: rec.IntervalTm,
+		late:       rec.Late,
+		counts:     rec.Counts,
+		dups:       rec.Dups,
+		joined:     rec.Joined,
+		bidPrice:   rec.BidPrice,
+		winPrice:   rec.WinPrice,
+		winCost:    rec.WinCost,
+		bidDomains: rec.BidDomains,
+		winDomains: rec.WinDomains,
+	}
+	for kind, l := range rec.Latency {
+		f.latency[kind] = latencyHistogram{buckets: l.Buckets, sumMs: l.SumMs, maxMs: l.MaxMs}
+	}
+	if rec.DomainWins != nil || rec.ExchangeWins != nil {
+		f.hitters = &heavyHitters{
+			domainWins:    rec.DomainWins,
+			domainSpend:   rec.DomainSpend,
+			exchangeWins:  rec.ExchangeWins,
+			exchangeSpend: rec.ExchangeSpend,
+		}
+	}
+	return f
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRecordWriter - keeps the records written
+type testRecordWriter struct {
+	lock    sync.Mutex
+	records []AggCounter
+}
+
+func (w *testRecordWriter) WriteRecord(aggrec AggCounter) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.records = append(w.records, aggrec)
+	return nil
+}
+
+// Bids written for each interval of a granularity, summed over the records
+func (w *testRecordWriter) bids(intervalStr string) map[time.Time]int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	bids := make(map[time.Time]int64)
+	for _, rec := range w.records {
+		if rec.Interval == intervalStr {
+			bids[rec.Timestamp.UTC()] += rec.Bids
+		}
+	}
+	return bids
+}
+
+// Reset the state shared by the pipeline, returning the writer of its records
+func resetPipeline(checkpointPath string) *testRecordWriter {
+	aggStore = newAggStore()
+	offsetTracker = newOffsetTracker()
+	watermarks = newWatermarks(time.Minute)
+	checkpoints = newCheckpointer(checkpointPath)
+	dedup = newDedup(nil, 0, 0)
+	funnelJoin = newFunnelJoin(10*time.Minute, 1000000)
+	pacing = newPacingMonitor([]int64{80, 100}, 0.2)
+	w := &testRecordWriter{}
+	recordWriter = w
+	return w
+}
+
+// Bindings of the default topic rules
+func testBindings(t testing.TB) map[string]TopicBinding {
+	rules, err := parseTopicRules([]string{"bids=bid", "wins=win", "pixels=pixel", "clicks=click"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics, err := resolveTopics(rules, []string{"bids", "wins", "pixels", "clicks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindings := make(map[string]TopicBinding)
+	for _, topic := range topics {
+		bindings[topic.Topic] = topic
+	}
+	return bindings
+}
+
+// A bids topic message
+func testBid(campaignID int64, tsMs int64, bidID string) []byte {
+	return []byte(fmt.Sprintf(`{"adid":"%d","crid":"1","exchange":"x","cost":"1.5","timestamp":%d,"oidStr":"%s"}`, campaignID, tsMs, bidID))
+}
+
+// Count 10 bids in the first interval, then one past the allowed lateness so the watermark completes it
+func countBids(bindings map[string]TopicBinding) {
+	for i := int64(0); i < 10; i++ {
+		countEvent(bindings, Event{Topic: "bids", Partition: 0, Offset: i, Value: testBid(1, testBaseMs+i, fmt.Sprint(i))})
+	}
+	countEvent(bindings, Event{Topic: "bids", Partition: 0, Offset: 10, Value: testBid(1, testBaseMs+600000, "10")})
+}
+
+// An interval written after a checkpoint must not come back from the checkpoint after a restart
+func TestCheckpointAfterFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aggregates.ckpt")
+	w := resetPipeline(path)
+	bindings := testBindings(t)
+
+	countBids(bindings)
+	if err := checkpoints.save(); err != nil {
+		t.Fatal(err)
+	}
+	writeLastInterval(Granularity{"5m", 300})
+	interval := time.Unix(0, testBaseMs*int64(time.Millisecond)).UTC()
+	if bids := w.bids("5m")[interval]; bids != 10 {
+		t.Fatalf("Wrote %d bids, want 10", bids)
+	}
+
+	// Restart from the checkpoint, the events are redelivered from the last acknowledged offset
+	w = resetPipeline(path)
+	if err := checkpoints.restore(); err != nil {
+		t.Fatal(err)
+	}
+	countBids(bindings)
+	writeLastInterval(Granularity{"5m", 300})
+	if bids := w.bids("5m")[interval]; bids != 0 {
+		t.Fatalf("Interval written again with %d bids after the restart", bids)
+	}
+}
+
+// The campaign spend of the pacing monitor carries over a restart
+func TestCheckpointPacingSpend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aggregates.ckpt")
+	resetPipeline(path)
+	bindings := testBindings(t)
+	for i := int64(0); i < 4; i++ {
+		win := fmt.Sprintf(`{"adId":"7","cridId":"1","pubId":"x","cost":"0.25","price":"1","timestamp":%d,"hash":"w%d"}`, testBaseMs+i, i)
+		countEvent(bindings, Event{Topic: "wins", Partition: 0, Offset: i, Value: []byte(win)})
+	}
+	if err := checkpoints.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	resetPipeline(path)
+	if err := checkpoints.restore(); err != nil {
+		t.Fatal(err)
+	}
+	spends := pacing.snapshot()
+	if len(spends) != 1 || spends[0].CampaignID != 7 {
+		t.Fatalf("Restored spends %+v, want campaign 7", spends)
+	}
+	if want := Micros(1000000); spends[0].Total != want || spends[0].DaySpent != want {
+		t.Fatalf("Restored total spend %s and daily spend %s, want %s", spends[0].Total, spends[0].DaySpent, want)
+	}
+}
+
+// Intervals in progress at a stop are saved to the checkpoint, not written, and written once after the restart
+func TestCheckpointStopRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aggregates.ckpt")
+	bindings := testBindings(t)
+	topics := []TopicBinding{bindings["bids"]}
+	newSource := func(complete bool) *MemorySource {
+		source := newMemorySource()
+		for i := int64(0); i < 10; i++ {
+			source.Add("bids", 0, nil, testBid(1, testBaseMs+i, fmt.Sprint(i)), time.Time{})
+		}
+		if complete {
+			source.Add("bids", 0, nil, testBid(1, testBaseMs+600000, "10"), time.Time{})
+		}
+		return source
+	}
+
+	w := resetPipeline(path)
+	source := newSource(false)
+	if err := consumeTopics(source, topics); err != nil {
+		t.Fatal(err)
+	}
+	writeAllIntervals(source)
+	if len(w.records) != 0 {
+		t.Fatalf("Wrote %d records at the stop, want them in the checkpoint", len(w.records))
+	}
+	if acked := source.Acked("bids", 0); acked != -1 {
+		t.Fatalf("Acknowledged to %d at the stop, want nothing", acked)
+	}
+
+	// Restart from the checkpoint, the events are redelivered as none was acknowledged
+	w = resetPipeline(path)
+	if err := checkpoints.restore(); err != nil {
+		t.Fatal(err)
+	}
+	source = newSource(true)
+	if err := consumeTopics(source, topics); err != nil {
+		t.Fatal(err)
+	}
+	writeLastInterval(Granularity{"5m", 300})
+	interval := time.Unix(0, testBaseMs*int64(time.Millisecond)).UTC()
+	if bids := w.bids("5m")[interval]; bids != 10 {
+		t.Fatalf("Wrote %d bids after the restart, want 10", bids)
+	}
+	for _, rec := range w.records {
+		if rec.Correction != "" {
+			t.Fatalf("Wrote a %s correction after the restart", rec.Correction)
+		}
+	}
+	if acked := source.Acked("bids", 0); acked != 9 {
+		t.Fatalf("Acknowledged to %d, want 9, the last event of the written interval", acked)
+	}
+}
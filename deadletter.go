@@ -0,0 +1,173 @@
+//
+//  Dead letters - messages rejected by the parsers.
+//  Rejected messages are sent to a dead letter sink (Kafka topic or local file) with the
+//  topic/partition/offset they came from and the parse error, and counted by topic.
+//  The redrive command re-publishes dead letters that parse after a fix.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// DeadLetter - a rejected message, where it came from and why it was rejected
+type DeadLetter struct {
+	Topic      string    `json:"topic"`
+	Partition  int32     `json:"partition"`
+	Offset     int64     `json:"offset"`
+	Key        string    `json:"key,omitempty"`
+	Value      string    `json:"value"`
+	Timestamp  time.Time `json:"timestamp"`
+	Error      string    `json:"error"`
+	RejectedAt time.Time `json:"rejectedAt"`
+}
+
+// EventCounts - events counted by name since startup, ie rejected messages by topic
+type EventCounts struct {
+	label  string
+	lock   *sync.Mutex
+	counts map[string]int64
+}
+
+// Dead letter sink, nil if rejected messages are only logged
+var deadLetters JSONSink
+
+// Instantiate the reject counters
+var rejectCounts = newEventCounts("Rejected messages")
+
+// Reject an event. It is counted and sent to the dead letter sink.
+func rejectEvent(ev Event, reason error) {
+	log1 := logger.GetLogger("rejectEvent")
+	rejectCounts.add(ev.Topic)
+	log1.Error(fmt.Sprintf("Rejected %s/%d/%d: %s", ev.Topic, ev.Partition, ev.Offset, reason))
+	if deadLetters == nil {
+		return
+	}
+	dl := DeadLetter{
+		Topic:      ev.Topic,
+		Partition:  ev.Partition,
+		Offset:     ev.Offset,
+		Key:        string(ev.Key),
+		Value:      string(ev.Value),
+		Timestamp:  ev.Timestamp,
+		Error:      reason.Error(),
+		RejectedAt: time.Now().UTC(),
+	}
+	if err := deadLetters.Send(dl.Topic, dl); err != nil {
+		log1.Alert(fmt.Sprintf("Dead letter not sent (%s): %s/%d/%d %s", err, ev.Topic, ev.Partition, ev.Offset, ev.Value))
+	}
+}
+
+func newEventCounts(label string) *EventCounts {
+	return &EventCounts{label: label, lock: new(sync.Mutex), counts: make(map[string]int64)}
+}
+
+func (r *EventCounts) add(name string) {
+	r.lock.Lock()
+	r.counts[name]++
+	r.lock.Unlock()
+}
+
+// Log the counts, if any
+func (r *EventCounts) log() {
+	log1 := logger.GetLogger("EventCounts")
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.counts) == 0 {
+		return
+	}
+	names := make([]string, 0, len(r.counts))
+	for name := range r.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counts := make([]string, len(names))
+	for i, name := range names {
+		counts[i] = fmt.Sprintf("%s=%d", name, r.counts[name])
+	}
+	log1.Warning(fmt.Sprintf("%s since startup: %s", r.label, strings.Join(counts, ", ")))
+}
+
+// Re-drive dead letters from the source. Dead letters that now parse with the parser of their
+// original topic are produced to that topic again, the others are sent to remaining.
+// A dead letter is acknowledged once produced or kept. The first one that is neither stops the
+// re-drive: the dead letters after it are not acknowledged either, so the next run reads them again.
+func redriveDeadLetters(source EventSource, topics []string, rules []TopicRule, producer sarama.SyncProducer, remaining JSONSink) error {
+	log1 := logger.GetLogger("redriveDeadLetters")
+	var lock sync.Mutex
+	var redriven, failed int64
+	var stopErr error
+	keep := func(dl DeadLetter, reason error) error {
+		dl.Error = reason.Error()
+		dl.RejectedAt = time.Now().UTC()
+		if remaining == nil {
+			return fmt.Errorf("No remaining file to keep it: %s", reason)
+		}
+		if err := remaining.Send(dl.Topic, dl); err != nil {
+			return fmt.Errorf("Not kept (%s): %s", err, reason)
+		}
+		lock.Lock()
+		failed++
+		lock.Unlock()
+		return nil
+	}
+	redrive := func(ev Event) error {
+		dl := DeadLetter{}
+		if err := json.Unmarshal(ev.Value, &dl); err != nil {
+			return keep(DeadLetter{Topic: ev.Topic, Partition: ev.Partition, Offset: ev.Offset, Value: string(ev.Value), Timestamp: ev.Timestamp}, fmt.Errorf("Not a dead letter: %s", err))
+		}
+		topic, err := bindTopic(rules, dl.Topic)
+		if err != nil {
+			return keep(dl, err)
+		}
+		if _, err := parseEvent(topic, []byte(dl.Value)); err != nil {
+			return keep(dl, err)
+		}
+		msg := &sarama.ProducerMessage{
+			Topic: dl.Topic,
+			Value: sarama.StringEncoder(dl.Value),
+		}
+		if dl.Key != "" {
+			msg.Key = sarama.StringEncoder(dl.Key)
+		}
+		if _, _, err := producer.SendMessage(msg); err != nil {
+			return keep(dl, err)
+		}
+		lock.Lock()
+		redriven++
+		lock.Unlock()
+		return nil
+	}
+	err := source.Consume(topics, func(ev Event) {
+		lock.Lock()
+		stopped := stopErr != nil
+		lock.Unlock()
+		if stopped {
+			return
+		}
+		if err := redrive(ev); err != nil {
+			lock.Lock()
+			if stopErr == nil {
+				stopErr = fmt.Errorf("Dead letter %s/%d/%d not re-driven, stopped before it: %s", ev.Topic, ev.Partition, ev.Offset, err)
+			}
+			lock.Unlock()
+			return
+		}
+		if ev.Ack != nil {
+			ev.Ack() // Produced or kept, the next run doesn't read it again
+		}
+	})
+	log1.Info(fmt.Sprintf("%d dead letters re-driven, %d still rejected.", redriven, failed))
+	if err != nil {
+		return err
+	}
+	return stopErr
+}
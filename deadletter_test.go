@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// stubProducer - sync producer keeping the messages sent, failing those of the values in fail
+type stubProducer struct {
+	sarama.SyncProducer
+	fail map[string]bool
+	sent []string
+}
+
+func (p *stubProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	value, _ := msg.Value.Encode()
+	if p.fail[string(value)] {
+		return 0, 0, errors.New("broker down")
+	}
+	p.sent = append(p.sent, string(value))
+	return 0, int64(len(p.sent) - 1), nil
+}
+
+// stubSink - JSON sink keeping the records sent
+type stubSink struct {
+	records []interface{}
+}
+
+func (s *stubSink) Send(key string, record interface{}) error {
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *stubSink) Close() error {
+	return nil
+}
+
+// Dead letters of three bids that now parse, in a memory source
+func testDeadLetters(t *testing.T) (*MemorySource, []string) {
+	source := newMemorySource()
+	bids := []string{}
+	for i := int64(0); i < 3; i++ {
+		bid := string(testBid(1, testBaseMs+i, fmt.Sprint(i)))
+		value, err := json.Marshal(DeadLetter{Topic: "bids", Value: bid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		source.Add("deadletters", 0, nil, value, time.Time{})
+		bids = append(bids, bid)
+	}
+	return source, bids
+}
+
+// A dead letter neither produced nor kept stops the re-drive before it is acknowledged
+func TestRedriveStopsUnacknowledged(t *testing.T) {
+	rules, err := parseTopicRules([]string{"bids=bid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, bids := testDeadLetters(t)
+	producer := &stubProducer{fail: map[string]bool{bids[1]: true}}
+	err = redriveDeadLetters(source, []string{"deadletters"}, rules, producer, nil)
+	if err == nil || !strings.Contains(err.Error(), "deadletters/0/1") {
+		t.Fatalf("Re-drive error %v, want the dead letter at offset 1", err)
+	}
+	if len(producer.sent) != 1 {
+		t.Fatalf("Produced %d dead letters, want 1 before the failure", len(producer.sent))
+	}
+	if acked := source.Acked("deadletters", 0); acked != 0 {
+		t.Fatalf("Acknowledged to %d, want 0, the dead letter produced", acked)
+	}
+
+	// Kept in the remaining sink instead, every dead letter is handled
+	source, _ = testDeadLetters(t)
+	producer.sent = nil
+	remaining := &stubSink{}
+	if err := redriveDeadLetters(source, []string{"deadletters"}, rules, producer, remaining); err != nil {
+		t.Fatal(err)
+	}
+	if len(producer.sent) != 2 || len(remaining.records) != 1 {
+		t.Fatalf("Produced %d and kept %d dead letters, want 2 and 1", len(producer.sent), len(remaining.records))
+	}
+	if acked := source.Acked("deadletters", 0); acked != 2 {
+		t.Fatalf("Acknowledged to %d, want 2, every dead letter", acked)
+	}
+}
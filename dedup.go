@@ -0,0 +1,171 @@
+//
+//  Duplicate event suppression. Exchanges retry win notifications and pixels fire twice.
+//  An event is a duplicate if an event of the same kind with the same key was seen within the
+//  dedup window of event time. The key is the bid id, or a hash of the configured fields.
+//  Only 64 bit hashes of the keys are kept, in a ring of fixed size, so memory is bounded.
+//  Duplicates are not counted as events, they are counted by topic and in each record.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields that can make up the dedup key
+var dedupFieldNames = []string{"bidid", "campaign", "creative", "exchange", "domain", "adtype", "timestamp", "price", "cost"}
+
+// dedupEntry - hash of an event key and its event time
+type dedupEntry struct {
+	hash    uint64
+	eventMs int64
+}
+
+// Dedup - keys of the events seen within the window
+type Dedup struct {
+	lock    *sync.Mutex
+	fields  []string         // Fields of the key, from dedupFieldNames
+	window  time.Duration    // Event time a key is kept. 0 disables dedup.
+	seen    map[uint64]int64 // Key hash to its latest event time
+	ring    []dedupEntry     // Keys in the order they were seen
+	head    int              // Oldest key in the ring
+	size    int              // Keys in the ring
+	latest  int64            // Latest event time seen
+	evicted int64            // Keys dropped before the window passed, the ring was full
+}
+
+// Instantiate the dedup stage, disabled unless configured
+var dedup = newDedup(nil, 0, 0)
+
+// Duplicate events by topic, since startup
+var dupCounts = newEventCounts("Duplicate events")
+
+func newDedup(fields []string, window time.Duration, maxKeys int) *Dedup {
+	if window <= 0 || maxKeys <= 0 {
+		return &Dedup{lock: new(sync.Mutex)}
+	}
+	return &Dedup{
+		lock:   new(sync.Mutex),
+		fields: fields,
+		window: window,
+		seen:   make(map[uint64]int64),
+		ring:   make([]dedupEntry, maxKeys),
+	}
+}
+
+// Parse the dedup key fields, ie bidid or exchange+bidid. Unknown or repeated fields are an error.
+func parseDedupFields(spec string) ([]string, error) {
+	fields := []string{}
+	for _, name := range strings.Split(spec, "+") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !containsString(dedupFieldNames, name) {
+			return nil, fmt.Errorf("Unknown dedup field %q", name)
+		}
+		if containsString(fields, name) {
+			return nil, fmt.Errorf("Dedup field %q is repeated", name)
+		}
+		fields = append(fields, name)
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("No dedup fields configured")
+	}
+	return fields, nil
+}
+
+// Hash the key fields of an event. False if the key has a bid id and the event has none.
+func (d *Dedup) key(kind EventKind, field EventFields) (uint64, bool) {
+	h := fnv.New64a()
+	h.Write([]byte{byte(kind)})
+	for _, name := range d.fields {
+		var v string
+		switch name {
+		case "bidid":
+			v = field.BidID
+		case "campaign":
+			v = strconv.FormatInt(field.CampaignID, 10)
+		case "creative":
+			v = strconv.FormatInt(field.CreativeID, 10)
+		case "exchange":
+			v = field.Exchange
+		case "domain":
+			v = field.Domain
+		case "adtype":
+			v = field.AdType
+		case "timestamp":
+			v = strconv.FormatInt(field.Timestamp, 10)
+		case "price":
+			v = field.Price.String()
+		case "cost":
+			v = field.Cost.String()
+		}
+		if name == "bidid" && v == "" {
+			return 0, false
+		}
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return h.Sum64(), true
+}
+
+// Check if the event is a duplicate of one seen within the window, and remember it
+func (d *Dedup) duplicate(kind EventKind, field EventFields) bool {
+	if d.window <= 0 {
+		return false
+	}
+	hash, keyed := d.key(kind, field)
+	if !keyed {
+		return false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if field.Timestamp > d.latest {
+		d.latest = field.Timestamp
+	}
+	d.expire()
+	if _, found := d.seen[hash]; found {
+		return true
+	}
+	if d.size == len(d.ring) {
+		d.pop()
+		d.evicted++
+	}
+	d.ring[(d.head+d.size)%len(d.ring)] = dedupEntry{hash, field.Timestamp}
+	d.size++
+	d.seen[hash] = field.Timestamp
+	return false
+}
+
+// Drop the keys past the window. Called with the lock held.
+func (d *Dedup) expire() {
+	windowMs := int64(d.window / time.Millisecond)
+	for d.size > 0 && d.ring[d.head].eventMs <= d.latest-windowMs {
+		d.pop()
+	}
+}
+
+// Drop the oldest key. Called with the lock held.
+func (d *Dedup) pop() {
+	oldest := d.ring[d.head]
+	if seenMs, found := d.seen[oldest.hash]; found && seenMs == oldest.eventMs {
+		delete(d.seen, oldest.hash)
+	}
+	d.head = (d.head + 1) % len(d.ring)
+	d.size--
+}
+
+// Log the number of keys held and dropped early, if dedup is enabled
+func (d *Dedup) log() {
+	log1 := logger.GetLogger("Dedup")
+	if d.window <= 0 {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	log1.Info(fmt.Sprintf("Dedup holds %d keys, %d dropped before the window passed.", d.size, d.evicted))
+}
@@ -0,0 +1,110 @@
+//
+//  Aggregation dimensions. Each dimension set groups the events by its dimensions only and
+//  is written as its own record stream, ie campaign+exchange for spend by exchange.
+//  Dimensions not in a set are left empty in its RecordKey. The creative dimension is the
+//  creative id and type, as banners and videos are numbered separately.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Dimension names, in the order they appear in a set name
+var dimensionNames = []string{"campaign", "creative", "exchange", "domain", "adtype"}
+
+// DimensionSet - the dimensions of one record stream
+type DimensionSet struct {
+	Name     string // Dimensions joined by +, ie campaign+exchange. Set in RecordKey.Dimensions
+	Campaign bool
+	Creative bool
+	Exchange bool
+	Domain   bool
+	AdType   bool
+}
+
+// Dimension sets to aggregate by, campaign and creative unless configured
+var dimensionSets = []DimensionSet{{Name: "campaign+creative", Campaign: true, Creative: true}}
+
+// Parse the dimension sets, ie campaign+creative or adtype. Unknown or repeated dimensions are an error.
+func parseDimensionSets(specs []string) ([]DimensionSet, error) {
+	result := []DimensionSet{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		set := DimensionSet{}
+		selected := map[string]bool{}
+		for _, name := range strings.Split(spec, "+") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if !containsString(dimensionNames, name) {
+				return nil, fmt.Errorf("Dimension set %q has unknown dimension %q", spec, name)
+			}
+			if selected[name] {
+				return nil, fmt.Errorf("Dimension set %q repeats dimension %q", spec, name)
+			}
+			selected[name] = true
+		}
+		names := []string{}
+		for _, name := range dimensionNames {
+			if selected[name] {
+				names = append(names, name)
+			}
+		}
+		set.Name = strings.Join(names, "+")
+		set.Campaign = selected["campaign"]
+		set.Creative = selected["creative"]
+		set.Exchange = selected["exchange"]
+		set.Domain = selected["domain"]
+		set.AdType = selected["adtype"]
+		for _, s := range result {
+			if s.Name == set.Name {
+				return nil, fmt.Errorf("Dimension set %q is configured twice", spec)
+			}
+		}
+		result = append(result, set)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("No dimension sets configured")
+	}
+	return result, nil
+}
+
+// Aggregation key of the event fields in the set, for an interval
+func (d DimensionSet) key(field EventFields, intervalStr string, intervalTs string) RecordKey {
+	key := RecordKey{
+		Dimensions:  d.Name,
+		IntervalStr: intervalStr,
+		IntervalTs:  intervalTs,
+	}
+	if d.Campaign {
+		key.CampaignID = field.CampaignID
+	}
+	if d.Creative {
+		key.CreativeID = field.CreativeID
+		key.Creative = creativeType(field)
+	}
+	if d.Exchange {
+		key.Exchange = field.Exchange
+	}
+	if d.Domain {
+		key.Domain = field.Domain
+	}
+	if d.AdType {
+		key.AdType = field.AdType
+	}
+	return key
+}
+
+// Creative type of an event, from its ad type or else the creative found in the campaign records.
+// Empty if neither has it.
+func creativeType(field EventFields) string {
+	if field.AdType == CreativeBanner || field.AdType == CreativeVideo {
+		return field.AdType
+	}
+	return findCampaign(field.CampaignID, field.CreativeID, "").Type
+}
@@ -0,0 +1,143 @@
+//
+//  Event sources deliver the bid, win, pixel and click messages to the aggregation.
+//  The aggregation only sees Events, so it can be fed from Kafka, from event files,
+//  or from memory.
+//
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Event - one message read from an event source
+type Event struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Timestamp time.Time // Source timestamp of the message, zero if the source doesn't have one
+	// Ack marks this event and every earlier event of the same topic/partition as processed.
+	// Nil if the source has nothing to acknowledge.
+	Ack func()
+}
+
+// EventSource - a source of events, split into topics and partitions
+type EventSource interface {
+	// Topics returns the topics the source can deliver, used to resolve the topic rules.
+	Topics() ([]string, error)
+	// Consume delivers the events of the topics to handler until the source is closed or exhausted.
+	// Events of a partition are delivered in order from a single goroutine,
+	// different partitions are delivered concurrently.
+	Consume(topics []string, handler func(Event)) error
+	// Close stops Consume and commits anything acknowledged.
+	Close() error
+}
+
+// MemorySource - event source holding its events in memory. Used by the pipeline tests.
+type MemorySource struct {
+	lock   *sync.Mutex
+	events map[PartitionID][]Event
+	acked  map[PartitionID]int64
+	closed bool
+}
+
+func newMemorySource() *MemorySource {
+	return &MemorySource{
+		lock:   new(sync.Mutex),
+		events: make(map[PartitionID][]Event),
+		acked:  make(map[PartitionID]int64),
+	}
+}
+
+// Add an event to the end of a partition. Offsets are assigned from 0 in order.
+func (s *MemorySource) Add(topic string, partition int32, key []byte, value []byte, timestamp time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := PartitionID{topic, partition}
+	s.events[id] = append(s.events[id], Event{
+		Topic:     topic,
+		Partition: partition,
+		Offset:    int64(len(s.events[id])),
+		Key:       key,
+		Value:     value,
+		Timestamp: timestamp,
+	})
+}
+
+// Topics returns the topics with events
+func (s *MemorySource) Topics() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seen := make(map[string]struct{})
+	topics := []string{}
+	for id := range s.events {
+		if _, found := seen[id.Topic]; !found {
+			seen[id.Topic] = struct{}{}
+			topics = append(topics, id.Topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// Consume delivers all the events of the topics and returns once they have been handled
+func (s *MemorySource) Consume(topics []string, handler func(Event)) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return errors.New("Memory source is closed")
+	}
+	partitions := make(map[PartitionID][]Event)
+	for id, events := range s.events {
+		if containsString(topics, id.Topic) {
+			partitions[id] = events
+		}
+	}
+	s.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for id, events := range partitions {
+		wg.Add(1)
+		go func(id PartitionID, events []Event) {
+			defer wg.Done()
+			for _, ev := range events {
+				offset := ev.Offset
+				ev.Ack = func() { s.ack(id, offset) }
+				handler(ev)
+			}
+		}(id, events)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (s *MemorySource) ack(id PartitionID, offset int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if acked, found := s.acked[id]; !found || offset > acked {
+		s.acked[id] = offset
+	}
+}
+
+// Acked returns the last offset acknowledged on the partition, -1 if none
+func (s *MemorySource) Acked(topic string, partition int32) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if acked, found := s.acked[PartitionID{topic, partition}]; found {
+		return acked
+	}
+	return -1
+}
+
+// Close the source
+func (s *MemorySource) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Events consumed from a source are acknowledged once their interval is written, not before
+func TestMemorySourcePipeline(t *testing.T) {
+	w := resetPipeline("")
+	source := newMemorySource()
+	for p := int32(0); p < 2; p++ {
+		for i := int64(0); i < 5; i++ {
+			source.Add("bids", p, nil, testBid(1, testBaseMs+i, fmt.Sprintf("%d-%d", p, i)), time.Time{})
+		}
+		// Past the allowed lateness, so the watermark completes the first interval
+		source.Add("bids", p, nil, testBid(1, testBaseMs+600000, fmt.Sprintf("%d-late", p)), time.Time{})
+	}
+	rules, err := parseTopicRules([]string{"bids=bid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	available, err := source.Topics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics, err := resolveTopics(rules, available)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := consumeTopics(source, topics); err != nil {
+		t.Fatal(err)
+	}
+	for p := int32(0); p < 2; p++ {
+		if acked := source.Acked("bids", p); acked != -1 {
+			t.Fatalf("Partition %d acknowledged to %d before any interval was written", p, acked)
+		}
+	}
+
+	writeLastInterval(Granularity{"5m", 300})
+	interval := time.Unix(0, testBaseMs*int64(time.Millisecond)).UTC()
+	if bids := w.bids("5m")[interval]; bids != 10 {
+		t.Fatalf("Wrote %d bids, want 10", bids)
+	}
+	for p := int32(0); p < 2; p++ {
+		if acked := source.Acked("bids", p); acked != 4 {
+			t.Fatalf("Partition %d acknowledged to %d, want 4, the last event of the written interval", p, acked)
+		}
+	}
+}
+
+// A backfill counts the events of its time range only, so the intervals on its bounds are whole
+func TestCountRange(t *testing.T) {
+	defer func(r EventTimeRange) { countRange = r }(countRange)
+	countRange = EventTimeRange{testBaseMs, testBaseMs + 300000}
+	resetPipeline("")
+	bindings := testBindings(t)
+	for i, tsMs := range []int64{testBaseMs - 1, testBaseMs, testBaseMs + 299999, testBaseMs + 300000} {
+		countEvent(bindings, Event{Topic: "bids", Partition: 0, Offset: int64(i), Value: testBid(1, tsMs, fmt.Sprint(i))})
+	}
+	records := aggStore.collect("", 0, true)
+	if len(records) != 1 {
+		t.Fatalf("Counted %d records, want 1", len(records))
+	}
+	for k, fields := range records {
+		if fields.intervalTs != testBaseMs || fields.counts[KindBid] != 2 {
+			t.Fatalf("Counted %d bids in %s, want 2 in the range", fields.counts[KindBid], k.IntervalTs)
+		}
+	}
+}
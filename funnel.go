@@ -0,0 +1,190 @@
+//
+//  Funnel joins - link a bid to its win, pixel and click by the RTB4FREE bid id.
+//  Each bid id is kept for the join window of event time after it was first seen, so
+//  memory is bounded by the window and by a maximum number of bid ids. A joined event is
+//  counted with the latency from the previous step, giving the win to pixel and pixel to
+//  click rates and latency distributions of each record.
+//
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Latency histogram bucket upper bounds in milliseconds. The last bucket is everything slower.
+var latencyBucketsMs = []int64{100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000, 300000, 900000}
+
+// funnelEntry - event times of the steps seen for a bid id, epoch milliseconds, 0 if not seen
+type funnelEntry struct {
+	bidID   string
+	firstMs int64 // Event time the bid id was first seen
+	steps   [numEventKinds]int64
+}
+
+// FunnelJoin - join state of the bid ids seen within the window
+type FunnelJoin struct {
+	lock       *sync.Mutex
+	entries    map[string]*list.Element
+	order      *list.List    // Entries in the order they were first seen, oldest first
+	window     time.Duration // Event time a bid id is kept after it was first seen. 0 disables the join.
+	maxEntries int           // Oldest entries are dropped beyond this
+	latestMs   int64         // Latest event time seen
+	expired    int64         // Entries dropped since startup
+}
+
+// latencyHistogram - latencies of the joined events of a step
+type latencyHistogram struct {
+	buckets [12]int64 // Counts by latencyBucketsMs, then slower. Must be len(latencyBucketsMs)+1.
+	sumMs   int64
+	maxMs   int64
+}
+
+// LatencySummary - latency distribution of a funnel step
+type LatencySummary struct {
+	Count        int64   `json:"count"`
+	MeanMs       int64   `json:"meanMs"`
+	P50Ms        int64   `json:"p50Ms"` // Upper bound of the bucket holding the percentile
+	P95Ms        int64   `json:"p95Ms"`
+	MaxMs        int64   `json:"maxMs"`
+	BucketCounts []int64 `json:"bucketCounts"` // Counts by latencyBucketsMs, the last is slower than all
+}
+
+// Instantiate the funnel join, 10 minutes unless configured
+var funnelJoin = newFunnelJoin(10*time.Minute, 1000000)
+
+func newFunnelJoin(window time.Duration, maxEntries int) *FunnelJoin {
+	return &FunnelJoin{
+		lock:       new(sync.Mutex),
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		window:     window,
+		maxEntries: maxEntries,
+	}
+}
+
+// Join an event to the earlier steps of its bid id. Sets Joined and LatencyMs of the field if the
+// previous step (bid for a win, win for a pixel, pixel for a click) has been seen.
+func (j *FunnelJoin) join(kind EventKind, field EventFields) EventFields {
+	if j.window <= 0 || field.BidID == "" {
+		return field
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if field.Timestamp > j.latestMs {
+		j.latestMs = field.Timestamp
+	}
+	j.expire()
+	var entry *funnelEntry
+	if el, found := j.entries[field.BidID]; found {
+		entry = el.Value.(*funnelEntry)
+	} else {
+		entry = &funnelEntry{bidID: field.BidID, firstMs: field.Timestamp}
+		j.entries[field.BidID] = j.order.PushBack(entry)
+	}
+	if kind != KindBid {
+		if prevMs := entry.steps[kind-1]; prevMs > 0 && entry.steps[kind] == 0 {
+			field.Joined = true
+			field.LatencyMs = field.Timestamp - prevMs
+			if field.LatencyMs < 0 {
+				field.LatencyMs = 0
+			}
+		}
+	}
+	if entry.steps[kind] == 0 {
+		entry.steps[kind] = field.Timestamp
+	}
+	return field
+}
+
+// Drop the entries past the window, and the oldest beyond the maximum. Called with the lock held.
+func (j *FunnelJoin) expire() {
+	windowMs := int64(j.window / time.Millisecond)
+	for el := j.order.Front(); el != nil; el = j.order.Front() {
+		entry := el.Value.(*funnelEntry)
+		if entry.firstMs > j.latestMs-windowMs && j.order.Len() < j.maxEntries {
+			break
+		}
+		j.order.Remove(el)
+		delete(j.entries, entry.bidID)
+		j.expired++
+	}
+}
+
+// Log the number of bid ids in the join state and the number dropped since startup
+func (j *FunnelJoin) log() {
+	log1 := logger.GetLogger("FunnelJoin")
+	if j.window <= 0 {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	log1.Info(fmt.Sprintf("Funnel join holds %d bid ids, %d expired since startup.", j.order.Len(), j.expired))
+}
+
+// Add a latency
+func (h *latencyHistogram) add(ms int64) {
+	i := 0
+	for i < len(latencyBucketsMs) && ms > latencyBucketsMs[i] {
+		i++
+	}
+	h.buckets[i]++
+	h.sumMs += ms
+	if ms > h.maxMs {
+		h.maxMs = ms
+	}
+}
+
+// Add the latencies of another histogram
+func (h *latencyHistogram) merge(o latencyHistogram) {
+	for i := range h.buckets {
+		h.buckets[i] += o.buckets[i]
+	}
+	h.sumMs += o.sumMs
+	if o.maxMs > h.maxMs {
+		h.maxMs = o.maxMs
+	}
+}
+
+// Summary of the histogram, nil if it is empty
+func (h *latencyHistogram) summary() *LatencySummary {
+	s := &LatencySummary{MaxMs: h.maxMs, BucketCounts: make([]int64, len(h.buckets))}
+	copy(s.BucketCounts, h.buckets[:])
+	for _, n := range h.buckets {
+		s.Count += n
+	}
+	if s.Count == 0 {
+		return nil
+	}
+	s.MeanMs = h.sumMs / s.Count
+	s.P50Ms = h.percentile(s.Count, 50)
+	s.P95Ms = h.percentile(s.Count, 95)
+	return s
+}
+
+// Upper bound of the bucket holding the percentile, the max for the slowest bucket
+func (h *latencyHistogram) percentile(count int64, pct int64) int64 {
+	rank := (count*pct + 99) / 100
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= rank {
+			if i < len(latencyBucketsMs) && latencyBucketsMs[i] < h.maxMs {
+				return latencyBucketsMs[i]
+			}
+			return h.maxMs
+		}
+	}
+	return h.maxMs
+}
+
+// Ratio of two counts, 0 if the denominator is 0
+func rate(n int64, d int64) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
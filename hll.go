@@ -0,0 +1,157 @@
+//
+//  HyperLogLog sketches for approximate distinct counts, ie distinct publisher domains of
+//  a campaign interval. A sketch has a fixed size whatever the number of values added.
+//  Sketches of the same precision merge by taking the highest register, so the sketches
+//  written by several consumers, or for several intervals, combine into hourly or daily uniques.
+//
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// Precision of the sketches, 2^12 registers. Standard error is about 1.6%.
+const hllPrecision = 12
+
+// Version of the serialized sketch
+const hllVersion = 1
+
+// HLL - HyperLogLog sketch
+type HLL struct {
+	p         uint8
+	registers []uint8
+}
+
+func newHLL() *HLL {
+	return &HLL{p: hllPrecision, registers: make([]uint8, 1<<hllPrecision)}
+}
+
+// Add a value to the sketch
+func (h *HLL) Add(value string) {
+	f := fnv.New64a()
+	f.Write([]byte(value))
+	x := f.Sum64()
+	// Mix the FNV hash, its high bits are poorly spread for short strings
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	idx := x >> (64 - h.p)
+	rank := uint8(bits.LeadingZeros64(x<<h.p|1<<(h.p-1)) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// Estimate the number of distinct values added
+func (h *HLL) Estimate() int64 {
+	if h == nil {
+		return 0
+	}
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// Linear counting for small cardinalities
+		est = m * math.Log(m/float64(zeros))
+	}
+	return int64(est + 0.5)
+}
+
+// Merge another sketch into this one. Sketches must have the same precision.
+func (h *HLL) Merge(o *HLL) error {
+	if o == nil {
+		return nil
+	}
+	if o.p != h.p {
+		return fmt.Errorf("Can't merge sketches of precision %d and %d", h.p, o.p)
+	}
+	for i, r := range o.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// Copy of the sketch
+func (h *HLL) clone() *HLL {
+	if h == nil {
+		return nil
+	}
+	c := &HLL{p: h.p, registers: make([]uint8, len(h.registers))}
+	copy(c.registers, h.registers)
+	return c
+}
+
+// MarshalBinary encodes the sketch as the version, the precision and the registers
+func (h *HLL) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 2, 2+len(h.registers))
+	b[0] = hllVersion
+	b[1] = h.p
+	return append(b, h.registers...), nil
+}
+
+// UnmarshalBinary decodes a sketch encoded by MarshalBinary
+func (h *HLL) UnmarshalBinary(b []byte) error {
+	if len(b) < 2 || b[0] != hllVersion {
+		return errors.New("Unknown sketch version")
+	}
+	p := b[1]
+	if p < 4 || p > 18 || len(b) != 2+1<<p {
+		return errors.New("Bad sketch length")
+	}
+	h.p = p
+	h.registers = make([]uint8, 1<<p)
+	copy(h.registers, b[2:])
+	return nil
+}
+
+// MarshalJSON writes the sketch as a base64 string
+func (h *HLL) MarshalJSON() ([]byte, error) {
+	b, err := h.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON reads a sketch written by MarshalJSON
+func (h *HLL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return h.UnmarshalBinary(b)
+}
+
+// Merge a sketch into another that may not have been created yet. Returns the merged sketch.
+func mergeHLL(h *HLL, o *HLL) *HLL {
+	if o == nil {
+		return h
+	}
+	if h == nil {
+		return o.clone()
+	}
+	h.Merge(o)
+	return h
+}
@@ -0,0 +1,96 @@
+//
+//  JSON sinks - records sent as newline delimited JSON to a local file, or as JSON messages
+//  to a Kafka topic. The dead letters and the alerts are sent to JSON sinks.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// JSONSink - destination of JSON records
+type JSONSink interface {
+	// Send the record. key is the Kafka message key, not written to files.
+	Send(key string, record interface{}) error
+	Close() error
+}
+
+// fileJSONSink - appends records to a file as newline delimited JSON
+type fileJSONSink struct {
+	lock *sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// kafkaJSONSink - produces records as JSON to a Kafka topic
+type kafkaJSONSink struct {
+	topic    string
+	producer sarama.SyncProducer
+}
+
+// Create a sink from its spec, file:<path> or kafka:<topic>. Empty spec is no sink.
+// name is the sink in the errors, ie Alert sink.
+func newJSONSink(name string, spec string, brokers []string, config *sarama.Config) (JSONSink, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	colon := strings.Index(spec, ":")
+	if colon < 0 {
+		return nil, fmt.Errorf("%s %q is not file:<path> or kafka:<topic>", name, spec)
+	}
+	switch kind, target := spec[:colon], spec[colon+1:]; kind {
+	case "file":
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &fileJSONSink{lock: new(sync.Mutex), file: f, enc: json.NewEncoder(f)}, nil
+	case "kafka":
+		config.Producer.Return.Successes = true // Required by the sync producer
+		producer, err := sarama.NewSyncProducer(brokers, config)
+		if err != nil {
+			return nil, err
+		}
+		return &kafkaJSONSink{topic: target, producer: producer}, nil
+	default:
+		return nil, fmt.Errorf("%s %q is not file:<path> or kafka:<topic>", name, spec)
+	}
+}
+
+// Send appends the record to the file
+func (s *fileJSONSink) Send(key string, record interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.enc.Encode(record)
+}
+
+// Close the file
+func (s *fileJSONSink) Close() error {
+	return s.file.Close()
+}
+
+// Send produces the record with the key
+func (s *kafkaJSONSink) Send(key string, record interface{}) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: s.topic,
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.ByteEncoder(value),
+	})
+	return err
+}
+
+// Close the producer
+func (s *kafkaJSONSink) Close() error {
+	return s.producer.Close()
+}
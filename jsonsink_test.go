@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Alerts and dead letters are appended to a file sink as newline delimited JSON
+func TestJSONSinkFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sink.json")
+	sink, err := newJSONSink("Test sink", "file:"+path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Send("7", Alert{Type: "pacing", CampaignID: 7, Metric: "dailySpent"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Send("bids", DeadLetter{Topic: "bids", Offset: 3, Value: "{"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"pacing","campaignId":7,"metric":"dailySpent","value":0,"threshold":0,"message":"","raisedAt":"0001-01-01T00:00:00Z"}` + "\n" +
+		`{"topic":"bids","partition":0,"offset":3,"value":"{","timestamp":"0001-01-01T00:00:00Z","error":"","rejectedAt":"0001-01-01T00:00:00Z"}` + "\n"
+	if string(data) != want {
+		t.Fatalf("Wrote %s, want %s", data, want)
+	}
+}
+
+func TestJSONSinkSpec(t *testing.T) {
+	if sink, err := newJSONSink("Test sink", "", nil, nil); sink != nil || err != nil {
+		t.Fatalf("Empty spec gave %v, %v, want no sink", sink, err)
+	}
+	for _, spec := range []string{"stdout", "http://host/alerts"} {
+		if _, err := newJSONSink("Test sink", spec, nil, nil); err == nil {
+			t.Fatalf("Spec %q accepted", spec)
+		}
+	}
+}
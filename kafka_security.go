@@ -0,0 +1,140 @@
+//
+//  TLS and SASL settings for connecting to secured Kafka brokers.
+//  TLS may use a private CA bundle and a client certificate. SASL supports
+//  PLAIN, SCRAM-SHA-256 and SCRAM-SHA-512 with the password read from a file.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+// KafkaSecurity - TLS and SASL settings for the brokers
+type KafkaSecurity struct {
+	TLS          bool   // Use TLS. Implied by any of the files below.
+	CAFile       string // PEM CA bundle to verify the brokers, system roots if empty
+	CertFile     string // PEM client certificate
+	KeyFile      string // PEM client key
+	Mechanism    string // SASL mechanism, none if empty
+	User         string // SASL user name
+	PasswordFile string // File holding the SASL password
+}
+
+// SCRAM hash functions
+var (
+	scramSHA256 scram.HashGeneratorFcn = func() hash.Hash { return sha256.New() }
+	scramSHA512 scram.HashGeneratorFcn = func() hash.Hash { return sha512.New() }
+)
+
+// xdgSCRAMClient - sarama.SCRAMClient using github.com/xdg/scram
+type xdgSCRAMClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+// Begin starts the SCRAM conversation
+func (x *xdgSCRAMClient) Begin(userName, password, authzID string) (err error) {
+	x.Client, err = x.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	x.ClientConversation = x.Client.NewConversation()
+	return nil
+}
+
+// Step answers a server challenge
+func (x *xdgSCRAMClient) Step(challenge string) (string, error) {
+	return x.ClientConversation.Step(challenge)
+}
+
+// Done reports if the conversation is complete
+func (x *xdgSCRAMClient) Done() bool {
+	return x.ClientConversation.Done()
+}
+
+// Apply the security settings to the sarama config
+func (sec KafkaSecurity) apply(config *sarama.Config) error {
+	if sec.TLS || sec.CAFile != "" || sec.CertFile != "" || sec.KeyFile != "" {
+		tlsConfig, err := sec.tlsConfig()
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+	if sec.Mechanism == "" {
+		return nil
+	}
+	if sec.User == "" {
+		return errors.New("SASL needs a user name")
+	}
+	password := ""
+	if sec.PasswordFile != "" {
+		b, err := ioutil.ReadFile(sec.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("SASL password file: %s", err)
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.User = sec.User
+	config.Net.SASL.Password = password
+	switch strings.ToUpper(sec.Mechanism) {
+	case sarama.SASLTypePlaintext:
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &xdgSCRAMClient{HashGeneratorFcn: scramSHA256}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &xdgSCRAMClient{HashGeneratorFcn: scramSHA512}
+		}
+	default:
+		return fmt.Errorf("Unsupported SASL mechanism %q (PLAIN | SCRAM-SHA-256 | SCRAM-SHA-512)", sec.Mechanism)
+	}
+	return nil
+}
+
+// TLS config with the CA bundle and client certificate
+func (sec KafkaSecurity) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if sec.CAFile != "" {
+		pem, err := ioutil.ReadFile(sec.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in CA file %s", sec.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if sec.CertFile != "" || sec.KeyFile != "" {
+		if sec.CertFile == "" || sec.KeyFile == "" {
+			return nil, errors.New("Client certificate needs both the cert and key files")
+		}
+		cert, err := tls.LoadX509KeyPair(sec.CertFile, sec.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// testCert - a generated certificate and its key
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+// Generate a certificate signed by the CA, self signed if ca is nil
+func newTestCert(t *testing.T, name string, serial int64, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, der: der, key: key}
+}
+
+// Write the certificate and key as PEM files in dir, returning their paths
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// The CA bundle and client certificate applied to the config complete a mutual TLS handshake
+// with a broker stand-in using a certificate of the same CA
+func TestKafkaSecurityTLSHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkatls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "Test CA", 1, nil)
+	caPath, _ := ca.write(t, dir, "ca")
+	server := newTestCert(t, "broker", 2, ca)
+	client := newTestCert(t, "rtb-consumer", 3, ca)
+	certPath, keyPath := client.write(t, dir, "client")
+
+	config := sarama.NewConfig()
+	if err := (KafkaSecurity{CAFile: caPath, CertFile: certPath, KeyFile: keyPath}).apply(config); err != nil {
+		t.Fatal(err)
+	}
+	if !config.Net.TLS.Enable || config.Net.SASL.Enable {
+		t.Fatalf("TLS enabled %v, SASL enabled %v, want TLS only", config.Net.TLS.Enable, config.Net.SASL.Enable)
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	peer := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			peer <- err.Error()
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			peer <- err.Error()
+			return
+		}
+		peer <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), config.Net.TLS.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if name := <-peer; name != "rtb-consumer" {
+		t.Fatalf("Broker saw client %q, want rtb-consumer", name)
+	}
+}
+
+// A broker certificate from another CA is refused
+func TestKafkaSecurityUnknownCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkatls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caPath, _ := newTestCert(t, "Test CA", 1, nil).write(t, dir, "ca")
+	server := newTestCert(t, "broker", 2, newTestCert(t, "Other CA", 1, nil))
+
+	config := sarama.NewConfig()
+	if err := (KafkaSecurity{CAFile: caPath}).apply(config); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	if conn, err := tls.Dial("tcp", listener.Addr().String(), config.Net.TLS.Config); err == nil {
+		conn.Close()
+		t.Fatal("Handshake with a broker of another CA succeeded")
+	}
+}
+
+func TestKafkaSecurityErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkatls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, _ := newTestCert(t, "rtb-consumer", 1, nil).write(t, dir, "client")
+	passwordPath := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordPath, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		sec  KafkaSecurity
+		want string // Part of the error
+	}{
+		{"missing key file", KafkaSecurity{CertFile: certPath, KeyFile: filepath.Join(dir, "missing.key")}, "Client certificate"},
+		{"cert without key", KafkaSecurity{CertFile: certPath}, "needs both the cert and key files"},
+		{"missing CA file", KafkaSecurity{CAFile: filepath.Join(dir, "missing.crt")}, "CA file"},
+		{"unknown mechanism", KafkaSecurity{Mechanism: "GSSAPI", User: "rtb", PasswordFile: passwordPath}, "Unsupported SASL mechanism"},
+		{"SASL without user", KafkaSecurity{Mechanism: "PLAIN", PasswordFile: passwordPath}, "needs a user name"},
+		{"missing password file", KafkaSecurity{Mechanism: "PLAIN", User: "rtb", PasswordFile: filepath.Join(dir, "missing")}, "SASL password file"},
+	}
+	for _, test := range tests {
+		err := test.sec.apply(sarama.NewConfig())
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.want)
+		}
+	}
+
+	config := sarama.NewConfig()
+	if err := (KafkaSecurity{Mechanism: "scram-sha-512", User: "rtb", PasswordFile: passwordPath}).apply(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA512 || config.Net.SASL.Password != "secret" || config.Net.SASL.SCRAMClientGeneratorFunc == nil {
+		t.Fatalf("SASL mechanism %s, password %q", config.Net.SASL.Mechanism, config.Net.SASL.Password)
+	}
+}
@@ -0,0 +1,138 @@
+//
+//  Campaign metadata snapshot. The campaign records read from the database are held in an
+//  immutable snapshot that is swapped in whole, so records are decorated from one consistent
+//  read while a refresh is in progress. The metadata loader rereads the provider on a schedule
+//  so campaigns made runnable after startup get their attributes. A failed refresh keeps the
+//  last good snapshot.
+//
+
+package main
+
+import (
+	mysqlpkg "database/sql"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Creative types of the campaign records
+const (
+	CreativeBanner = "banner"
+	CreativeVideo  = "video"
+)
+
+// CampaignSnapshot - campaign records read together from the database
+type CampaignSnapshot struct {
+	Banners  CampaignBanners
+	Videos   CampaignVideos
+	Budgets  CampaignBudgets
+	LoadedAt time.Time // Zero if nothing has been read
+	Degraded bool      `json:"-"` // Not loaded from the provider: empty, or read from the cache
+
+	creatives map[creativeKey]CampaignCreativeFields // Set by index
+}
+
+// creativeKey - creative of a campaign. Banner and video ids are from different tables.
+type creativeKey struct {
+	Type       string
+	CampaignID int64
+	CreativeID int64
+}
+
+// Current snapshot, a *CampaignSnapshot
+var campaignSnapshot atomic.Value
+
+// The current snapshot, empty until the first read
+func currentCampaigns() *CampaignSnapshot {
+	if snapshot, ok := campaignSnapshot.Load().(*CampaignSnapshot); ok {
+		return snapshot
+	}
+	return &CampaignSnapshot{}
+}
+
+// Index the creatives of the snapshot by type, campaign and creative. Called before it is swapped in.
+func (s *CampaignSnapshot) index() {
+	s.creatives = make(map[creativeKey]CampaignCreativeFields, len(s.Banners)+len(s.Videos))
+	for _, v := range s.Banners {
+		s.creatives[creativeKey{CreativeBanner, v.ID, v.BannerID}] = CampaignCreativeFields{
+			Type:           CreativeBanner,
+			Regions:        v.Regions,
+			CampaignName:   v.CampaignName.String,
+			AdDomain:       v.AdDomain.String,
+			CampaignStatus: v.Status.String,
+			CampaignStart:  campaignTime(v.ActivateTime),
+			CampaignEnd:    campaignTime(v.ExpireTime),
+			CreativeName:   v.Name.String,
+			Width:          v.Width.Int64,
+			Height:         v.Height.Int64,
+			BidPrice:       creativeBidPrice(v.ID, v.BannerID, v.BidPrice),
+		}
+	}
+	for _, v := range s.Videos {
+		s.creatives[creativeKey{CreativeVideo, v.ID, v.VideoID}] = CampaignCreativeFields{
+			Type:           CreativeVideo,
+			Regions:        v.Regions,
+			CampaignName:   v.CampaignName.String,
+			AdDomain:       v.AdDomain.String,
+			CampaignStatus: v.Status.String,
+			CampaignStart:  campaignTime(v.ActivateTime),
+			CampaignEnd:    campaignTime(v.ExpireTime),
+			CreativeName:   v.Name.String,
+			Width:          v.Width.Int64,
+			Height:         v.Height.Int64,
+			VideoDuration:  v.Duration.Int64,
+			BidPrice:       creativeBidPrice(v.ID, v.VideoID, v.BidPrice),
+		}
+	}
+}
+
+// A DATETIME column as RFC3339, as stored if it doesn't parse. Empty if NULL.
+func campaignTime(col mysqlpkg.NullString) string {
+	if !col.Valid || col.String == "" {
+		return ""
+	}
+	tm, err := time.Parse(mysqlTimeLayout, col.String)
+	if err != nil {
+		return col.String
+	}
+	return tm.UTC().Format(time.RFC3339)
+}
+
+// The bid price of a creative in micro units, 0 if NULL or not a decimal
+func creativeBidPrice(campaignID int64, creativeID int64, col mysqlpkg.NullString) Micros {
+	log1 := logger.GetLogger("creativeBidPrice")
+	if !col.Valid || col.String == "" {
+		return 0
+	}
+	price, err := parseMicros(col.String)
+	if err != nil {
+		log1.Warning(fmt.Sprintf("Campaign %d creative %d bid price: %s", campaignID, creativeID, err))
+		return 0
+	}
+	return price
+}
+
+// Swap in a new snapshot
+func swapCampaigns(snapshot *CampaignSnapshot) {
+	campaignSnapshot.Store(snapshot)
+}
+
+// Log the age and record counts of the current snapshot, and the readiness if degraded
+func logCampaignSnapshot() {
+	log1 := logger.GetLogger("Campaign snapshot")
+	snapshot := currentCampaigns()
+	ready, reason := metadataLoader.ready()
+	if snapshot.LoadedAt.IsZero() {
+		log1.Warning(fmt.Sprintf("No campaign snapshot loaded, records have no campaign attributes. Metadata %s.", reason))
+		return
+	}
+	age := time.Since(snapshot.LoadedAt) / time.Second * time.Second
+	msg := fmt.Sprintf("Campaign snapshot of %s, age %s: %d banner, %d video and %d budget records. %d refreshes failed since.",
+		snapshot.LoadedAt.Format(time.RFC3339), age, len(snapshot.Banners), len(snapshot.Videos), len(snapshot.Budgets),
+		metadataLoader.failureCount())
+	if ready {
+		log1.Info(msg)
+	} else {
+		log1.Warning(fmt.Sprintf("%s Metadata %s.", msg, reason))
+	}
+}
@@ -0,0 +1,230 @@
+//
+//  Loading of the campaign metadata at startup and in the background. A provider that is down
+//  at startup is retried with exponential backoff and jitter up to the startup timeout, an attempt
+//  still waiting for the provider is given up at the timeout. Then the consumer exits, or starts
+//  degraded on an empty snapshot or the cached copy of the last snapshot loaded, as configured,
+//  and retries in the background until the provider answers.
+//  Readiness is degraded until a snapshot has been loaded from the provider.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Startup policies when the metadata provider can't be read within the startup timeout
+const (
+	MetadataWait  = "wait"  // Exit, the campaign attributes are required
+	MetadataEmpty = "empty" // Start without campaign attributes
+	MetadataCache = "cache" // Start with the cached snapshot, without attributes if there is none
+)
+
+// Retry delays of the metadata provider, doubling from the base up to the max
+const (
+	metadataRetryBase = time.Second
+	metadataRetryMax  = time.Minute
+)
+
+// Jitter of the retries, seeded so consumers restarted together don't retry together.
+// Only the loader uses it, from one goroutine at a time.
+var backoffRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// MetadataLoader - loads the campaign snapshots from the provider
+type MetadataLoader struct {
+	provider  MetadataProvider
+	cachePath string        // Copy of the last snapshot loaded, no cache if empty
+	every     time.Duration // Time between refreshes, 0 for none once loaded
+	loading   *sync.Mutex   // One load at a time, a load given up at startup may still be running
+	lock      *sync.Mutex   // Protects lastErr and failures
+	lastErr   error         // Error of the last load, nil if it succeeded
+	failures  int64         // Loads failed in a row
+}
+
+// Instantiate the metadata loader, set up from the configuration in main
+var metadataLoader = newMetadataLoader(nil, "", 0)
+
+func newMetadataLoader(provider MetadataProvider, cachePath string, every time.Duration) *MetadataLoader {
+	return &MetadataLoader{provider: provider, cachePath: cachePath, every: every, loading: new(sync.Mutex), lock: new(sync.Mutex)}
+}
+
+// Load a snapshot from the provider, swap it in and cache it
+func (l *MetadataLoader) load() error {
+	log1 := logger.GetLogger("MetadataLoader load")
+	l.loading.Lock()
+	defer l.loading.Unlock()
+	snapshot, err := l.provider.Load()
+	l.lock.Lock()
+	l.lastErr = err
+	if err != nil {
+		l.failures++
+	} else {
+		l.failures = 0
+	}
+	l.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	swapCampaigns(snapshot)
+	if l.cachePath != "" {
+		if err := writeCampaignCache(l.cachePath, snapshot); err != nil {
+			log1.Warning(fmt.Sprintf("Campaign cache %s not written: %s", l.cachePath, err))
+		}
+	}
+	return nil
+}
+
+// Load a snapshot, giving up if the provider doesn't answer within the timeout. The load goes on
+// in the background, its snapshot is swapped in if it completes later.
+func (l *MetadataLoader) loadWithin(timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- l.load()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("No answer within %s", timeout)
+	}
+}
+
+// Load the first snapshot, retrying until the timeout. If none is loaded by then the policy
+// decides: an error to exit, or a degraded start on an empty or the cached snapshot.
+func (l *MetadataLoader) start(timeout time.Duration, policy string) error {
+	log1 := logger.GetLogger("MetadataLoader start")
+	deadline := time.Now().Add(timeout)
+	for attempt := 0; ; attempt++ {
+		err := l.loadWithin(time.Until(deadline))
+		if err == nil {
+			return nil
+		}
+		delay := backoffDelay(attempt, metadataRetryBase, metadataRetryMax)
+		if time.Now().Add(delay).After(deadline) {
+			log1.Error(fmt.Sprintf("Metadata from %s not read in %d attempts: %s", l.provider, attempt+1, err))
+			break
+		}
+		log1.Warning(fmt.Sprintf("Metadata from %s not read, retrying in %s: %s", l.provider, delay, err))
+		time.Sleep(delay)
+	}
+	if policy == MetadataCache && l.cachePath != "" {
+		snapshot, err := readCampaignCache(l.cachePath)
+		if err == nil {
+			swapCampaigns(snapshot)
+			log1.Warning(fmt.Sprintf("Starting degraded on the campaign cache %s of %s.", l.cachePath, snapshot.LoadedAt.Format(time.RFC3339)))
+			return nil
+		}
+		log1.Warning(fmt.Sprintf("Campaign cache %s not read: %s", l.cachePath, err))
+	}
+	if policy == MetadataCache || policy == MetadataEmpty {
+		swapCampaigns(&CampaignSnapshot{Degraded: true})
+		log1.Warning("Starting degraded without campaign metadata.")
+		return nil
+	}
+	return fmt.Errorf("Metadata from %s not read within %s: %s", l.provider, timeout, l.lastError())
+}
+
+// Reload the snapshot until stopped, every refresh period, or with backoff while degraded.
+// Returns once loaded if there is no refresh period.
+func (l *MetadataLoader) refresh(stop <-chan struct{}) {
+	log1 := logger.GetLogger("MetadataLoader refresh")
+	for {
+		wait := l.every
+		if currentCampaigns().Degraded {
+			wait = backoffDelay(int(l.failureCount()), metadataRetryBase, metadataRetryMax)
+		}
+		if wait <= 0 {
+			return
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := l.load(); err != nil {
+			log1.Warning(fmt.Sprintf("Campaign refresh from %s failed (%d in a row), keeping the current snapshot: %s", l.provider, l.failureCount(), err))
+			continue
+		}
+		logCampaignSnapshot()
+	}
+}
+
+// Readiness of the metadata, ready once a snapshot has been loaded from the provider.
+// The reason says why not.
+func (l *MetadataLoader) ready() (bool, string) {
+	snapshot := currentCampaigns()
+	if !snapshot.Degraded && !snapshot.LoadedAt.IsZero() {
+		return true, "ready"
+	}
+	reason := "degraded, no campaign metadata"
+	if !snapshot.LoadedAt.IsZero() {
+		reason = "degraded, cached campaign metadata of " + snapshot.LoadedAt.Format(time.RFC3339)
+	}
+	if err := l.lastError(); err != nil {
+		reason += fmt.Sprintf(", %d loads failed, last error: %s", l.failureCount(), err)
+	}
+	return false, reason
+}
+
+func (l *MetadataLoader) lastError() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.lastErr
+}
+
+func (l *MetadataLoader) failureCount() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.failures
+}
+
+// Exponential backoff with jitter. The delay doubles each attempt up to max, and up to half of it is taken off at random.
+func backoffDelay(attempt int, base time.Duration, max time.Duration) time.Duration {
+	d := max
+	if attempt < 30 && base<<uint(attempt) < max {
+		d = base << uint(attempt)
+	}
+	return d - time.Duration(backoffRand.Int63n(int64(d/2)+1))
+}
+
+// Write the snapshot to the cache file. The file is replaced whole.
+func writeCampaignCache(path string, snapshot *CampaignSnapshot) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(snapshot); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Read a snapshot from the cache file. It is degraded, the provider may have changed since.
+func readCampaignCache(path string) (*CampaignSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snapshot := &CampaignSnapshot{}
+	if err := json.NewDecoder(f).Decode(snapshot); err != nil {
+		return nil, err
+	}
+	snapshot.Degraded = true
+	snapshot.index()
+	return snapshot, nil
+}
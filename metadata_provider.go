@@ -0,0 +1,202 @@
+//
+//  Campaign metadata providers. The campaign snapshot is read from the campaign manager's
+//  MySQL database, a static JSON or YAML file, or an HTTP endpoint serving the same JSON,
+//  selected by --metadata. The file and HTTP providers let the consumer run without the
+//  rtb4free database. Times are DATETIME strings as the database stores them.
+//
+
+package main
+
+import (
+	mysqlpkg "database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// MetadataProvider - source of the campaign snapshots
+type MetadataProvider interface {
+	Load() (*CampaignSnapshot, error)
+	String() string // Where the campaigns are read from, for the log
+}
+
+// MetadataCampaigns - campaigns of a metadata file or endpoint
+type MetadataCampaigns struct {
+	Campaigns []MetadataCampaign `json:"campaigns" yaml:"campaigns"`
+}
+
+// MetadataCampaign - a campaign with its budget limits and creatives. Amounts are decimals.
+type MetadataCampaign struct {
+	ID           int64              `json:"id" yaml:"id"`
+	Name         string             `json:"name" yaml:"name"`
+	AdDomain     string             `json:"adDomain" yaml:"adDomain"`
+	Status       string             `json:"status" yaml:"status"`
+	Regions      string             `json:"regions" yaml:"regions"`
+	ActivateTime string             `json:"activateTime" yaml:"activateTime"`
+	ExpireTime   string             `json:"expireTime" yaml:"expireTime"`
+	TotalBudget  string             `json:"totalBudget" yaml:"totalBudget"`
+	DailyBudget  string             `json:"dailyBudget" yaml:"dailyBudget"`
+	HourlyBudget string             `json:"hourlyBudget" yaml:"hourlyBudget"`
+	Banners      []MetadataCreative `json:"banners" yaml:"banners"`
+	Videos       []MetadataCreative `json:"videos" yaml:"videos"`
+}
+
+// MetadataCreative - a banner or video of a campaign. Duration is in seconds, videos only.
+type MetadataCreative struct {
+	ID       int64  `json:"id" yaml:"id"`
+	Name     string `json:"name" yaml:"name"`
+	Width    int64  `json:"width" yaml:"width"`
+	Height   int64  `json:"height" yaml:"height"`
+	Duration int64  `json:"duration" yaml:"duration"`
+	BidPrice string `json:"bidPrice" yaml:"bidPrice"`
+}
+
+// mysqlMetadata - reads the campaign manager database
+type mysqlMetadata struct {
+	host     string
+	dbname   string
+	user     string
+	password string
+}
+
+// fileMetadata - reads a JSON or YAML file, by its extension
+type fileMetadata struct {
+	path string
+}
+
+// httpMetadata - gets the JSON from an HTTP endpoint
+type httpMetadata struct {
+	url    string
+	client *http.Client
+}
+
+// Create the metadata provider from its spec, mysql, file:<path> or an http(s) URL.
+// The mysql provider uses the MySQL flags.
+func newMetadataProvider(spec string, mysqlHost string, mysqlDbname string, mysqlUser string, mysqlPassword string) (MetadataProvider, error) {
+	switch {
+	case spec == "mysql":
+		return &mysqlMetadata{host: mysqlHost, dbname: mysqlDbname, user: mysqlUser, password: mysqlPassword}, nil
+	case strings.HasPrefix(spec, "file:"):
+		return &fileMetadata{path: strings.TrimPrefix(spec, "file:")}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &httpMetadata{url: spec, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("Metadata provider %q is not mysql, file:<path> or an http(s) URL", spec)
+}
+
+// Load reads the runnable campaigns of the database
+func (p *mysqlMetadata) Load() (*CampaignSnapshot, error) {
+	return readCampaignSnapshot(p.host, p.dbname, p.user, p.password)
+}
+
+func (p *mysqlMetadata) String() string {
+	return fmt.Sprintf("mysql %s/%s", p.host, p.dbname)
+}
+
+// Load reads the file
+func (p *fileMetadata) Load() (*CampaignSnapshot, error) {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	campaigns := MetadataCampaigns{}
+	switch strings.ToLower(filepath.Ext(p.path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &campaigns)
+	default:
+		err = json.Unmarshal(data, &campaigns)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Metadata file %s: %s", p.path, err)
+	}
+	return campaigns.snapshot(), nil
+}
+
+func (p *fileMetadata) String() string {
+	return "file " + p.path
+}
+
+// Load gets the JSON from the endpoint
+func (p *httpMetadata) Load() (*CampaignSnapshot, error) {
+	resp, err := p.client.Get(p.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Metadata endpoint %s returned %s", p.url, resp.Status)
+	}
+	campaigns := MetadataCampaigns{}
+	if err := json.NewDecoder(resp.Body).Decode(&campaigns); err != nil {
+		return nil, fmt.Errorf("Metadata endpoint %s: %s", p.url, err)
+	}
+	return campaigns.snapshot(), nil
+}
+
+func (p *httpMetadata) String() string {
+	return p.url
+}
+
+// Convert the campaigns to a snapshot, as if read from the database: runnable campaigns only
+func (m MetadataCampaigns) snapshot() *CampaignSnapshot {
+	snapshot := &CampaignSnapshot{LoadedAt: time.Now().UTC()}
+	for _, c := range m.Campaigns {
+		if c.Status != "runnable" {
+			continue
+		}
+		for _, b := range c.Banners {
+			snapshot.Banners = append(snapshot.Banners, CampaignBannerFields{
+				ID:           c.ID,
+				BannerID:     b.ID,
+				Regions:      nullString(c.Regions),
+				CampaignName: nullString(c.Name),
+				AdDomain:     nullString(c.AdDomain),
+				Status:       nullString(c.Status),
+				ActivateTime: nullString(c.ActivateTime),
+				ExpireTime:   nullString(c.ExpireTime),
+				Name:         nullString(b.Name),
+				Width:        mysqlpkg.NullInt64{Int64: b.Width, Valid: true},
+				Height:       mysqlpkg.NullInt64{Int64: b.Height, Valid: true},
+				BidPrice:     nullString(b.BidPrice),
+			})
+		}
+		for _, v := range c.Videos {
+			snapshot.Videos = append(snapshot.Videos, CampaignVideoFields{
+				ID:           c.ID,
+				VideoID:      v.ID,
+				Regions:      nullString(c.Regions),
+				CampaignName: nullString(c.Name),
+				AdDomain:     nullString(c.AdDomain),
+				Status:       nullString(c.Status),
+				ActivateTime: nullString(c.ActivateTime),
+				ExpireTime:   nullString(c.ExpireTime),
+				Name:         nullString(v.Name),
+				Width:        mysqlpkg.NullInt64{Int64: v.Width, Valid: true},
+				Height:       mysqlpkg.NullInt64{Int64: v.Height, Valid: true},
+				Duration:     mysqlpkg.NullInt64{Int64: v.Duration, Valid: true},
+				BidPrice:     nullString(v.BidPrice),
+			})
+		}
+		snapshot.Budgets = append(snapshot.Budgets, CampaignBudgetFields{
+			ID:           c.ID,
+			TotalBudget:  nullString(c.TotalBudget),
+			DailyBudget:  nullString(c.DailyBudget),
+			HourlyBudget: nullString(c.HourlyBudget),
+			ActivateTime: nullString(c.ActivateTime),
+			ExpireTime:   nullString(c.ExpireTime),
+		})
+	}
+	snapshot.index()
+	return snapshot
+}
+
+// A column value, NULL if empty
+func nullString(s string) mysqlpkg.NullString {
+	return mysqlpkg.NullString{String: s, Valid: s != ""}
+}
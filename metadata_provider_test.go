@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Records get the attributes of runnable campaigns from the provider, selected by --attributes
+func TestMetadataAttributes(t *testing.T) {
+	defer swapCampaigns(currentCampaigns())
+	defer func(a map[string]bool) { recordAttributes = a }(recordAttributes)
+	provider := &stubMetadata{campaigns: MetadataCampaigns{Campaigns: []MetadataCampaign{
+		{
+			ID: 1, Name: "Spring", AdDomain: "example.com", Status: "runnable", ActivateTime: "2023-11-01 00:00:00",
+			Banners: []MetadataCreative{{ID: 10, Name: "Leaderboard", Width: 728, Height: 90, BidPrice: "2.5"}},
+			Videos:  []MetadataCreative{{ID: 10, Name: "Preroll", Width: 640, Height: 480, Duration: 15}},
+		},
+		{
+			ID: 2, Name: "Paused", Status: "offline",
+			Banners: []MetadataCreative{{ID: 20, Name: "Skyscraper", Width: 160, Height: 600}},
+		},
+	}}}
+	if err := newMetadataLoader(provider, "", 0).load(); err != nil {
+		t.Fatal(err)
+	}
+
+	banner := findCampaign(1, 10, CreativeBanner)
+	if banner.Type != CreativeBanner || banner.CreativeName != "Leaderboard" || banner.CampaignStart != "2023-11-01T00:00:00Z" || banner.BidPrice != 2500000 {
+		t.Fatalf("Banner %+v", banner)
+	}
+	if video := findCampaign(1, 10, CreativeVideo); video.Type != CreativeVideo || video.VideoDuration != 15 {
+		t.Fatalf("Video %+v", video)
+	}
+	if paused := findCampaign(2, 20, ""); paused.Type != "" {
+		t.Fatalf("Campaign that isn't runnable found: %+v", paused)
+	}
+
+	var err error
+	if recordAttributes, err = parseRecordAttributes([]string{"campaignname", "width", "creativeBidPrice"}); err != nil {
+		t.Fatal(err)
+	}
+	aggrec := AggCounter{}
+	aggrec.setAttributes(banner)
+	if !reflect.DeepEqual(aggrec, AggCounter{CampaignName: "Spring", Width: 728, CreativeBidPrice: 2500000}) {
+		t.Fatalf("Attributes %+v, want the campaign name, width and bid price only", aggrec)
+	}
+}
+
+// A banner and a video with the same creative id are separate records of the default dimensions,
+// each with its own attributes. A pixel without an ad type is counted with the creative found.
+func TestCreativeTypeRecords(t *testing.T) {
+	defer swapCampaigns(currentCampaigns())
+	defer func(a map[string]bool) { recordAttributes = a }(recordAttributes)
+	provider := &stubMetadata{campaigns: MetadataCampaigns{Campaigns: []MetadataCampaign{{
+		ID: 1, Name: "Spring", Status: "runnable",
+		Banners: []MetadataCreative{{ID: 10, Name: "Leaderboard", Width: 728, Height: 90}},
+		Videos:  []MetadataCreative{{ID: 10, Name: "Preroll", Width: 640, Height: 480, Duration: 15}},
+	}}}}
+	if err := newMetadataLoader(provider, "", 0).load(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if recordAttributes, err = parseRecordAttributes([]string{"creativename", "width"}); err != nil {
+		t.Fatal(err)
+	}
+	w := resetPipeline("")
+	bindings := testBindings(t)
+	events := []Event{
+		{Topic: "bids", Value: []byte(fmt.Sprintf(`{"adid":"1","crid":"10","adtype":"banner","timestamp":%d,"oidStr":"b"}`, testBaseMs))},
+		{Topic: "bids", Value: []byte(fmt.Sprintf(`{"adid":"1","crid":"10","adtype":"video","timestamp":%d,"oidStr":"v1"}`, testBaseMs+1))},
+		{Topic: "bids", Value: []byte(fmt.Sprintf(`{"adid":"1","crid":"10","adtype":"video","timestamp":%d,"oidStr":"v2"}`, testBaseMs+2))},
+		{Topic: "pixels", Value: []byte(fmt.Sprintf(`{"ad_id":"1","creative_id":"10","timestamp":%d,"bid_id":"p"}`, testBaseMs+3))},
+		// Past the allowed lateness on both topics, so the watermark completes the first interval
+		{Topic: "bids", Value: []byte(fmt.Sprintf(`{"adid":"2","crid":"20","timestamp":%d,"oidStr":"next"}`, testBaseMs+600000))},
+		{Topic: "pixels", Value: []byte(fmt.Sprintf(`{"ad_id":"2","creative_id":"20","timestamp":%d,"bid_id":"next"}`, testBaseMs+600000))},
+	}
+	for i, ev := range events {
+		ev.Offset = int64(i)
+		countEvent(bindings, ev)
+	}
+	writeLastInterval(Granularity{"5m", 300})
+
+	interval := time.Unix(0, testBaseMs*int64(time.Millisecond)).UTC()
+	got := map[string]AggCounter{}
+	for _, rec := range w.records {
+		if rec.Timestamp.Equal(interval) {
+			got[rec.CreativeType] = rec
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("Wrote records %+v, want a banner and a video", got)
+	}
+	if banner := got[CreativeBanner]; banner.CreativeName != "Leaderboard" || banner.Width != 728 || banner.Bids != 1 || banner.Pixels != 1 {
+		t.Fatalf("Banner record %+v", banner)
+	}
+	if video := got[CreativeVideo]; video.CreativeName != "Preroll" || video.Width != 640 || video.Bids != 2 || video.Pixels != 0 {
+		t.Fatalf("Video record %+v", video)
+	}
+}
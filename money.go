@@ -0,0 +1,87 @@
+//
+//  Money amounts in micro units (millionths of the currency unit).
+//  Prices and costs are parsed exactly from the decimal in the message and summed as
+//  integers, so totals reconcile with billing. Floats are never used for amounts.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// Micros - money amount in millionths of the currency unit
+type Micros int64
+
+// Micro units in a currency unit
+const microsPerUnit = 1000000
+
+// Amounts are decimals with an optional exponent of up to 3 digits, ie 1.25 or 2.5e-3.
+// Fractions, base prefixes and underscores that big.Rat also reads are not amounts.
+var decimalAmount = regexp.MustCompile(`^[+-]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][+-]?[0-9]{1,3})?$`)
+
+// UnmarshalJSON reads a JSON number or a quoted number. Digits past the sixth decimal are
+// rounded half away from zero. Empty or null is zero.
+func (m *Micros) UnmarshalJSON(b []byte) error {
+	s := strings.TrimSpace(string(b))
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = strings.TrimSpace(s[1 : len(s)-1])
+	}
+	if s == "" || s == "null" {
+		*m = 0
+		return nil
+	}
+	v, err := parseMicros(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// Parse a decimal amount to micro units
+func parseMicros(s string) (Micros, error) {
+	if !decimalAmount.MatchString(s) {
+		return 0, fmt.Errorf("Bad amount %q", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("Bad amount %q", s)
+	}
+	r.Mul(r, big.NewRat(microsPerUnit, 1))
+	q, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	// Round half away from zero
+	if rem.Sign() != 0 && new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(r.Denom()) >= 0 {
+		q.Add(q, big.NewInt(int64(r.Sign())))
+	}
+	if !q.IsInt64() {
+		return 0, errors.New("Amount out of range " + s)
+	}
+	return Micros(q.Int64()), nil
+}
+
+// Amount per n units, scaled, rounded half away from zero. Zero if n is zero.
+func (m Micros) per(n int64, scale int64) Micros {
+	if n == 0 {
+		return 0
+	}
+	total := int64(m) * scale
+	if total < 0 {
+		return Micros((total - n/2) / n)
+	}
+	return Micros((total + n/2) / n)
+}
+
+// String formats the amount as a decimal, ie 1.250000
+func (m Micros) String() string {
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	return fmt.Sprintf("%s%d.%06d", sign, v/microsPerUnit, v%microsPerUnit)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMicros(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Micros
+	}{
+		{"1.25", 1250000},
+		{"-1.25", -1250000},
+		{"+3", 3000000},
+		{"0.1", 100000},
+		{".5", 500000},
+		{"7.", 7000000},
+		{"2.5e-3", 2500},
+		{"1E2", 100000000},
+		{"0.0000005", 1}, // Half away from zero
+		{"0.0000004999", 0},
+		{"-0.0000005", -1},
+		{"-0.0000004999", 0},
+		{"1.0000015", 1000002},
+		{"-1.0000015", -1000002},
+		{"9223372036854.775807", 9223372036854775807},
+	}
+	for _, test := range tests {
+		got, err := parseMicros(test.in)
+		if err != nil {
+			t.Errorf("%s: %s", test.in, err)
+		} else if got != test.want {
+			t.Errorf("%s parsed as %d, want %d", test.in, got, test.want)
+		}
+	}
+	for _, in := range []string{"3/7", "0x10", "0b1", "1_000", "1e", "e5", ".", "1.5.2", "1e1000000000", "9223372036855", "Inf", ""} {
+		if got, err := parseMicros(in); err == nil {
+			t.Errorf("%q parsed as %d, want an error", in, got)
+		}
+	}
+}
+
+func TestMicrosJSON(t *testing.T) {
+	var v struct {
+		Number Micros `json:"number"`
+		Quoted Micros `json:"quoted"`
+		Null   Micros `json:"null"`
+	}
+	if err := json.Unmarshal([]byte(`{"number":0.75,"quoted":" 1.5 ","null":null}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Number != 750000 || v.Quoted != 1500000 || v.Null != 0 {
+		t.Fatalf("Unmarshaled %+v", v)
+	}
+	if err := json.Unmarshal([]byte(`{"quoted":"1/2"}`), &v); err == nil {
+		t.Fatal("Fraction unmarshaled as an amount")
+	}
+}
+
+func TestMicrosPer(t *testing.T) {
+	tests := []struct {
+		m     Micros
+		n     int64
+		scale int64
+		want  Micros
+	}{
+		{1000000, 4, 1, 250000},
+		{5, 2, 1, 3}, // Half away from zero
+		{-5, 2, 1, -3},
+		{3, 2, 1, 2},
+		{-3, 2, 1, -2},
+		{1, 4, 1, 0},
+		{-1, 4, 1, 0},
+		{2500000, 1000, 1000, 2500000}, // CPM of 1000 wins costing 2.5
+		{1000000, 0, 1000, 0},
+	}
+	for _, test := range tests {
+		if got := test.m.per(test.n, test.scale); got != test.want {
+			t.Errorf("%d per %d scaled by %d is %d, want %d", test.m, test.n, test.scale, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+//
+//  Track the offsets consumed into the aggregation counters.
+//  Offsets for a partition are only acknowledged to the event source once every
+//  aggregate that includes those messages has been written, so a restart re-reads
+//  any message whose interval was still in memory (at-least-once).
+//  With checkpoints, the counters of the coarser granularities are saved with each write before
+//  the offsets are acknowledged, so offsets only wait for the finest granularity. Otherwise a
+//  message is held until its interval is written in every granularity, ie up to a day for 1d.
+//
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PartitionID - topic and partition of a consumed message
+type PartitionID struct {
+	Topic     string
+	Partition int32
+}
+
+// offsetRange - lowest and highest offset counted into one interval
+type offsetRange struct {
+	low  int64
+	high int64
+	ack  func() // Acknowledges the event before low
+}
+
+// pendingInterval - interval of a granularity that has not been written
+type pendingInterval struct {
+	intervalStr string
+	intervalTs  int64 // Epoch milliseconds
+}
+
+// partitionOffsets - offsets of a partition that are waiting for their intervals to be written
+type partitionOffsets struct {
+	pending   map[pendingInterval]offsetRange // Interval to the offsets counted into it
+	last      int64                           // Last offset read from the partition
+	highest   int64                           // Highest offset read, those up to it are counted
+	lastAck   func()                          // Acknowledges the event at last
+	committed int64                           // Last offset released
+}
+
+// OffsetTracker - per partition offset state, shared by all the partition consumers
+type OffsetTracker struct {
+	lock       *sync.Mutex
+	partitions map[PartitionID]*partitionOffsets
+	finestOnly bool // Offsets wait only for the finest granularity, the others are checkpointed
+}
+
+// Instantiate the offset tracker
+var offsetTracker = newOffsetTracker()
+
+// flushLock - partition consumers hold the read lock while counting a message,
+// the flush holds the write lock so no message is counted between writing the
+// aggregates and releasing their offsets.
+var flushLock sync.RWMutex
+
+func newOffsetTracker() *OffsetTracker {
+	return &OffsetTracker{
+		lock:       new(sync.Mutex),
+		partitions: make(map[PartitionID]*partitionOffsets),
+	}
+}
+
+// Record a consumed message. intervals are the interval timestamps the message was counted in,
+// indexed like granularities, -1 where it was not counted. If counted is false the message did not add to any aggregate
+// (ie, unparseable) and intervals is ignored.
+// ack acknowledges the message and everything before it on the partition.
+func (t *OffsetTracker) track(topic string, partition int32, offset int64, intervals []int64, counted bool, ack func()) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	id := PartitionID{topic, partition}
+	p, ok := t.partitions[id]
+	if !ok {
+		p = &partitionOffsets{
+			pending:   make(map[pendingInterval]offsetRange),
+			last:      -1,
+			highest:   -1,
+			committed: -1,
+		}
+		t.partitions[id] = p
+	}
+	prevAck := p.lastAck
+	p.last = offset
+	if offset > p.highest {
+		p.highest = offset
+	}
+	p.lastAck = ack
+	if !counted {
+		return
+	}
+	finest := finestGranularity(granularities)
+	for i, intervalTs := range intervals {
+		if intervalTs < 0 || (t.finestOnly && granularities[i].IntervalSecs != finest.IntervalSecs) {
+			continue
+		}
+		interval := pendingInterval{granularities[i].IntervalStr, intervalTs}
+		if r, found := p.pending[interval]; found {
+			if offset < r.low {
+				r.low = offset
+			}
+			if offset > r.high {
+				r.high = offset
+			}
+			p.pending[interval] = r
+		} else {
+			p.pending[interval] = offsetRange{offset, offset, prevAck}
+		}
+	}
+}
+
+// Check if an event is redelivered, at or before the highest offset read from its partition.
+// It is already counted, or rejected.
+func (t *OffsetTracker) counted(ev Event) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p, found := t.partitions[PartitionID{ev.Topic, ev.Partition}]
+	return found && ev.Offset <= p.highest
+}
+
+// Forget the intervals of the granularity that have been written (interval <= tsMs, or everything
+// if sendAll; an empty intervalStr is every granularity) and return, for each partition that moved,
+// the ack of the last message that can be marked as processed. Every message up to that one
+// belongs to intervals that have been written in every granularity.
+func (t *OffsetTracker) release(intervalStr string, tsMs int64, sendAll bool) map[PartitionID]func() {
+	log1 := logger.GetLogger("OffsetTracker release")
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ready := make(map[PartitionID]func())
+	for id, p := range t.partitions {
+		for interval := range p.pending {
+			if intervalStr != "" && interval.intervalStr != intervalStr {
+				continue
+			}
+			if sendAll || interval.intervalTs <= tsMs {
+				delete(p.pending, interval)
+			}
+		}
+		offset, ack := p.last, p.lastAck
+		for _, r := range p.pending {
+			if r.low-1 < offset {
+				offset, ack = r.low-1, r.ack
+			}
+		}
+		if offset > p.committed {
+			p.committed = offset
+			if ack != nil {
+				ready[id] = ack
+			}
+			log1.Debug(fmt.Sprintf("%s/%d offset %d ready to commit.", id.Topic, id.Partition, offset))
+		}
+	}
+	return ready
+}
+
+// Last offset read from each partition
+func (t *OffsetTracker) lastOffsets() map[PartitionID]int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	offsets := make(map[PartitionID]int64, len(t.partitions))
+	for id, p := range t.partitions {
+		offsets[id] = p.last
+	}
+	return offsets
+}
+
+// Acks released by flushes whose checkpoint was not saved, acknowledged with the next one that is.
+// Only the flushes use them, one at a time.
+var heldAcks = make(map[PartitionID]func())
+
+// Hold the released offsets until a checkpoint is saved
+func holdOffsets(acks map[PartitionID]func()) {
+	for id, ack := range acks {
+		heldAcks[id] = ack
+	}
+}
+
+// Acknowledge the released offsets on the event source, and those held before them
+func commitOffsets(acks map[PartitionID]func()) {
+	for id, ack := range heldAcks {
+		if _, found := acks[id]; !found {
+			ack()
+		}
+	}
+	heldAcks = make(map[PartitionID]func())
+	for _, ack := range acks {
+		ack()
+	}
+}
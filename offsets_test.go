@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// With 5m and 1d, offsets are acknowledged once the 5m interval is written if checkpointed,
+// otherwise they wait for the 1d interval
+func TestOffsetsReleaseFinest(t *testing.T) {
+	defer func(gs []Granularity) { granularities = gs }(granularities)
+	granularities = []Granularity{{"5m", 300}, {"1d", 86400}}
+
+	for _, finestOnly := range []bool{true, false} {
+		tracker := newOffsetTracker()
+		tracker.finestOnly = finestOnly
+		acked := int64(-1)
+		for offset := int64(0); offset < 3; offset++ {
+			offset := offset
+			intervals := []int64{testBaseMs + offset*300000, testBaseMs}
+			tracker.track("bids", 0, offset, intervals, true, func() { acked = offset })
+		}
+
+		commitOffsets(tracker.release("5m", testBaseMs+300000, false))
+		want := int64(1)
+		if !finestOnly {
+			want = -1
+		}
+		if acked != want {
+			t.Fatalf("finestOnly %v: acknowledged offset %d after the 5m write, want %d", finestOnly, acked, want)
+		}
+
+		commitOffsets(tracker.release("1d", testBaseMs, false))
+		if want = 1; acked != want {
+			t.Fatalf("finestOnly %v: acknowledged offset %d after the 1d write, want %d", finestOnly, acked, want)
+		}
+	}
+}
+
+// Events redelivered by the source are counted once
+func TestRedeliveredCountedOnce(t *testing.T) {
+	resetPipeline("")
+	bindings := testBindings(t)
+	for delivery := 0; delivery < 2; delivery++ {
+		for i := int64(0); i < 10; i++ {
+			countEvent(bindings, Event{Topic: "bids", Partition: 0, Offset: i, Value: testBid(1, testBaseMs+i, fmt.Sprint(i))})
+		}
+	}
+	var bids int64
+	for _, fields := range aggStore.collect("", 0, true) {
+		bids += fields.counts[KindBid]
+	}
+	if bids != 10 {
+		t.Fatalf("Counted %d bids, want 10", bids)
+	}
+}
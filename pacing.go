@@ -0,0 +1,348 @@
+//
+//  Campaign budget pacing. Win costs are added to the spend of their campaign as they are
+//  consumed, by UTC day and hour of the win's event time. On every flush the spend of each
+//  runnable campaign is compared to its total, daily and hourly budget limits, the end of day
+//  spend is projected from the spend so far, and alerts are raised as spend crosses the
+//  configured percentages of a limit. Total spend is the spend seen since startup, carried
+//  over restarts by the checkpoints.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pace of a campaign's spend against its daily budget
+const (
+	PaceOn        = "on"        // Projected end of day spend is within the tolerance of the daily budget
+	PaceOver      = "over"      // Projected to spend more than the daily budget
+	PaceUnder     = "under"     // Projected to spend less than the daily budget
+	PaceExhausted = "exhausted" // A budget limit has been spent
+	PaceInactive  = "inactive"  // Outside the activation window
+	PaceUnlimited = "unlimited" // No daily budget
+)
+
+// Layout of the DATETIME columns
+const mysqlTimeLayout = "2006-01-02 15:04:05"
+
+// campaignSpend - win costs of a campaign
+type campaignSpend struct {
+	total     Micros
+	dayMs     int64 // Start of the UTC day of daySpent, epoch milliseconds
+	daySpent  Micros
+	hourMs    int64 // Start of the hour of hourSpent, epoch milliseconds
+	hourSpent Micros
+	alerted   map[string]bool // Alerts raised for the current periods
+}
+
+// PacingMonitor - spend of the campaigns with wins
+type PacingMonitor struct {
+	lock      *sync.Mutex
+	campaigns map[int64]*campaignSpend
+	alertAt   []int64 // Percentages of a budget limit that raise an alert
+	tolerance float64 // Fraction of the daily budget the projection may be off and still be on pace
+}
+
+// PacingStatus - pacing record of a campaign, written on every flush. Amounts in micro units.
+type PacingStatus struct {
+	CampaignID     int64     `json:"campaignId"`
+	Timestamp      time.Time `json:"timestamp"`
+	Pace           string    `json:"pace"`
+	TotalBudget    Micros    `json:"totalBudgetMicros,omitempty"`
+	DailyBudget    Micros    `json:"dailyBudgetMicros,omitempty"`
+	HourlyBudget   Micros    `json:"hourlyBudgetMicros,omitempty"`
+	TotalSpent     Micros    `json:"totalSpentMicros"`
+	DailySpent     Micros    `json:"dailySpentMicros"`
+	HourlySpent    Micros    `json:"hourlySpentMicros"`
+	ProjectedDaily Micros    `json:"projectedDailyMicros"`
+}
+
+// campaignBudget - parsed budget limits of a campaign, 0 if not set
+type campaignBudget struct {
+	total    Micros
+	daily    Micros
+	hourly   Micros
+	activate time.Time
+	expire   time.Time
+}
+
+// Instantiate the pacing monitor
+var pacing = newPacingMonitor([]int64{80, 100}, 0.2)
+
+func newPacingMonitor(alertAt []int64, tolerance float64) *PacingMonitor {
+	return &PacingMonitor{
+		lock:      new(sync.Mutex),
+		campaigns: make(map[int64]*campaignSpend),
+		alertAt:   alertAt,
+		tolerance: tolerance,
+	}
+}
+
+// Parse the alert percentages, ie 80,100
+func parseAlertPercentages(specs []string) ([]int64, error) {
+	result := []int64{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		pct, err := strconv.ParseInt(strings.TrimSuffix(spec, "%"), 10, 64)
+		if err != nil || pct <= 0 {
+			return nil, fmt.Errorf("Bad pacing alert percentage %q", spec)
+		}
+		result = append(result, pct)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result, nil
+}
+
+// Add the cost of a win to its campaign
+func (p *PacingMonitor) addWin(field EventFields) {
+	dayMs := field.Timestamp - field.Timestamp%(86400*1000)
+	hourMs := field.Timestamp - field.Timestamp%(3600*1000)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	c, found := p.campaigns[field.CampaignID]
+	if !found {
+		c = &campaignSpend{alerted: make(map[string]bool)}
+		p.campaigns[field.CampaignID] = c
+	}
+	c.total += field.Cost
+	if dayMs > c.dayMs {
+		c.dayMs, c.daySpent = dayMs, 0
+	}
+	if dayMs == c.dayMs {
+		c.daySpent += field.Cost
+	}
+	if hourMs > c.hourMs {
+		c.hourMs, c.hourSpent = hourMs, 0
+	}
+	if hourMs == c.hourMs {
+		c.hourSpent += field.Cost
+	}
+}
+
+// Copy the spend of the campaigns for a checkpoint
+func (p *PacingMonitor) snapshot() []CheckpointSpend {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	result := make([]CheckpointSpend, 0, len(p.campaigns))
+	for id, c := range p.campaigns {
+		spend := CheckpointSpend{
+			CampaignID: id,
+			Total:      c.total,
+			DayMs:      c.dayMs,
+			DaySpent:   c.daySpent,
+			HourMs:     c.hourMs,
+			HourSpent:  c.hourSpent,
+		}
+		for key := range c.alerted {
+			spend.Alerted = append(spend.Alerted, key)
+		}
+		result = append(result, spend)
+	}
+	return result
+}
+
+// Restore the spend of the campaigns from a checkpoint
+func (p *PacingMonitor) restore(spends []CheckpointSpend) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, spend := range spends {
+		c := &campaignSpend{
+			total:     spend.Total,
+			dayMs:     spend.DayMs,
+			daySpent:  spend.DaySpent,
+			hourMs:    spend.HourMs,
+			hourSpent: spend.HourSpent,
+			alerted:   make(map[string]bool),
+		}
+		for _, key := range spend.Alerted {
+			c.alerted[key] = true
+		}
+		p.campaigns[spend.CampaignID] = c
+	}
+}
+
+// Parse the budget limits of a campaign record
+func parseCampaignBudget(rec CampaignBudgetFields) (campaignBudget, error) {
+	b := campaignBudget{}
+	amounts := []struct {
+		col string // Empty if NULL
+		dst *Micros
+	}{
+		{rec.TotalBudget.String, &b.total},
+		{rec.DailyBudget.String, &b.daily},
+		{rec.HourlyBudget.String, &b.hourly},
+	}
+	for _, a := range amounts {
+		if a.col == "" {
+			continue
+		}
+		v, err := parseMicros(a.col)
+		if err != nil {
+			return b, err
+		}
+		*a.dst = v
+	}
+	var err error
+	if rec.ActivateTime.Valid && rec.ActivateTime.String != "" {
+		if b.activate, err = time.Parse(mysqlTimeLayout, rec.ActivateTime.String); err != nil {
+			return b, err
+		}
+	}
+	if rec.ExpireTime.Valid && rec.ExpireTime.String != "" {
+		if b.expire, err = time.Parse(mysqlTimeLayout, rec.ExpireTime.String); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// Pacing status of the runnable campaigns at now, raising alerts for the limits crossed
+func (p *PacingMonitor) status(budgets CampaignBudgets, now time.Time) []PacingStatus {
+	log1 := logger.GetLogger("PacingMonitor status")
+	nowMs := timeMs(now)
+	dayMs := nowMs - nowMs%(86400*1000)
+	hourMs := nowMs - nowMs%(3600*1000)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	result := make([]PacingStatus, 0, len(budgets))
+	for _, rec := range budgets {
+		budget, err := parseCampaignBudget(rec)
+		if err != nil {
+			log1.Error(fmt.Sprintf("Campaign %d budget: %s", rec.ID, err))
+			continue
+		}
+		st := PacingStatus{
+			CampaignID:   rec.ID,
+			Timestamp:    now,
+			TotalBudget:  budget.total,
+			DailyBudget:  budget.daily,
+			HourlyBudget: budget.hourly,
+		}
+		c := p.campaigns[rec.ID]
+		if c != nil {
+			st.TotalSpent = c.total
+			if c.dayMs == dayMs {
+				st.DailySpent = c.daySpent
+			}
+			if c.hourMs == hourMs {
+				st.HourlySpent = c.hourSpent
+			}
+		}
+		// Project the spend over the part of the day the campaign is active
+		startMs := dayMs
+		if !budget.activate.IsZero() && timeMs(budget.activate) > startMs {
+			startMs = timeMs(budget.activate)
+		}
+		endMs := dayMs + 86400*1000
+		if !budget.expire.IsZero() && timeMs(budget.expire) < endMs {
+			endMs = timeMs(budget.expire)
+		}
+		if elapsedSecs := (nowMs - startMs) / 1000; elapsedSecs > 0 && endMs > startMs {
+			st.ProjectedDaily = st.DailySpent.per(elapsedSecs, (endMs-startMs)/1000)
+		} else {
+			st.ProjectedDaily = st.DailySpent
+		}
+		st.Pace = budget.pace(st, now, p.tolerance)
+		if c != nil {
+			p.alert(c, budget, st, dayMs, hourMs)
+		}
+		result = append(result, st)
+	}
+	return result
+}
+
+// Pace of the campaign's spend
+func (b campaignBudget) pace(st PacingStatus, now time.Time, tolerance float64) string {
+	switch {
+	case !b.activate.IsZero() && now.Before(b.activate), !b.expire.IsZero() && !now.Before(b.expire):
+		return PaceInactive
+	case b.total > 0 && st.TotalSpent >= b.total, b.daily > 0 && st.DailySpent >= b.daily, b.hourly > 0 && st.HourlySpent >= b.hourly:
+		return PaceExhausted
+	case b.daily == 0:
+		return PaceUnlimited
+	case float64(st.ProjectedDaily) > float64(b.daily)*(1+tolerance):
+		return PaceOver
+	case float64(st.ProjectedDaily) < float64(b.daily)*(1-tolerance):
+		return PaceUnder
+	}
+	return PaceOn
+}
+
+// Raise the alerts for the limits crossed in the current periods, once per period. Called with the lock held.
+func (p *PacingMonitor) alert(c *campaignSpend, b campaignBudget, st PacingStatus, dayMs int64, hourMs int64) {
+	limits := []struct {
+		metric string
+		budget Micros
+		spent  Micros
+		period int64
+	}{
+		{"totalSpent", b.total, st.TotalSpent, 0},
+		{"dailySpent", b.daily, st.DailySpent, dayMs},
+		{"hourlySpent", b.hourly, st.HourlySpent, hourMs},
+	}
+	for _, l := range limits {
+		if l.budget <= 0 {
+			continue
+		}
+		for _, pct := range p.alertAt {
+			threshold := l.budget.per(100, pct)
+			key := fmt.Sprintf("%s %d %d", l.metric, pct, l.period)
+			if l.spent < threshold || c.alerted[key] {
+				continue
+			}
+			c.alerted[key] = true
+			raiseAlert(Alert{
+				Type:       "pacing",
+				CampaignID: st.CampaignID,
+				Metric:     l.metric,
+				Value:      float64(l.spent) / microsPerUnit,
+				Threshold:  float64(threshold) / microsPerUnit,
+				Message:    fmt.Sprintf("%s %s is %d%% or more of the budget %s", l.metric, l.spent, pct, l.budget),
+				RaisedAt:   st.Timestamp,
+			})
+		}
+	}
+	key := fmt.Sprintf("pace %s %d", st.Pace, dayMs)
+	if st.Pace == PaceOver && !c.alerted[key] {
+		c.alerted[key] = true
+		raiseAlert(Alert{
+			Type:       "pacing",
+			CampaignID: st.CampaignID,
+			Metric:     "projectedDailySpent",
+			Value:      float64(st.ProjectedDaily) / microsPerUnit,
+			Threshold:  float64(b.daily) / microsPerUnit,
+			Message:    fmt.Sprintf("Projected daily spend %s is over the daily budget %s", st.ProjectedDaily, b.daily),
+			RaisedAt:   st.Timestamp,
+		})
+	}
+	// Forget the alerts of past periods
+	for key := range c.alerted {
+		fields := strings.Fields(key)
+		if period, _ := strconv.ParseInt(fields[len(fields)-1], 10, 64); period != 0 && period != dayMs && period != hourMs {
+			delete(c.alerted, key)
+		}
+	}
+}
+
+// Write the pacing status of the runnable campaigns to the log
+func writePacingStatus(now time.Time) {
+	log1 := logger.GetLogger("writePacingStatus")
+	for _, st := range pacing.status(currentCampaigns().Budgets, now) {
+		jsonStr, err := json.Marshal(st)
+		if err != nil {
+			log1.Error(fmt.Sprintf("Error writing pacing of campaign %d: %s", st.CampaignID, err))
+			continue
+		}
+		log1.Info(fmt.Sprintf("Pacing record %s", jsonStr))
+	}
+}
@@ -9,6 +9,7 @@ import (
 	mysqlpkg "database/sql"
 	"errors"
 	"fmt"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -19,6 +20,19 @@ type CampaignBannerFields struct {
 	ID       int64
 	BannerID int64
 	Regions  mysqlpkg.NullString
+
+	// Campaign attributes. Times are DATETIME strings as stored.
+	CampaignName mysqlpkg.NullString
+	AdDomain     mysqlpkg.NullString
+	Status       mysqlpkg.NullString
+	ActivateTime mysqlpkg.NullString
+	ExpireTime   mysqlpkg.NullString
+
+	// Banner attributes. Bid price is the decimal bid CPM.
+	Name     mysqlpkg.NullString
+	Width    mysqlpkg.NullInt64
+	Height   mysqlpkg.NullInt64
+	BidPrice mysqlpkg.NullString
 }
 
 // CampaignVideoFields - Joined fields Campaigns and BannerVideos
@@ -27,11 +41,47 @@ type CampaignVideoFields struct {
 	ID      int64
 	VideoID int64
 	Regions mysqlpkg.NullString
+
+	// Campaign attributes. Times are DATETIME strings as stored.
+	CampaignName mysqlpkg.NullString
+	AdDomain     mysqlpkg.NullString
+	Status       mysqlpkg.NullString
+	ActivateTime mysqlpkg.NullString
+	ExpireTime   mysqlpkg.NullString
+
+	// Video attributes. Duration is in seconds, bid price is the decimal bid CPM.
+	Name     mysqlpkg.NullString
+	Width    mysqlpkg.NullInt64
+	Height   mysqlpkg.NullInt64
+	Duration mysqlpkg.NullInt64
+	BidPrice mysqlpkg.NullString
+}
+
+// CampaignBudgetFields - Budget limits and activation window of a campaign.
+//	Amounts are decimals and times are DATETIME strings as stored, NULL if not set.
+type CampaignBudgetFields struct {
+	ID           int64
+	TotalBudget  mysqlpkg.NullString
+	DailyBudget  mysqlpkg.NullString
+	HourlyBudget mysqlpkg.NullString
+	ActivateTime mysqlpkg.NullString
+	ExpireTime   mysqlpkg.NullString
 }
 
 // CampaignCreativeFields - generic campaign and creative fields
 type CampaignCreativeFields struct {
-	Regions mysqlpkg.NullString
+	Type           string // CreativeBanner or CreativeVideo
+	Regions        mysqlpkg.NullString
+	CampaignName   string
+	AdDomain       string
+	CampaignStatus string
+	CampaignStart  string // RFC3339, empty if not set
+	CampaignEnd    string
+	CreativeName   string
+	Width          int64
+	Height         int64
+	VideoDuration  int64 // Seconds, videos only
+	BidPrice       Micros
 }
 
 // CampaignBanners - Array of records with structure CampaignBannerFields
@@ -40,38 +90,44 @@ type CampaignBanners []CampaignBannerFields
 // CampaignVideos - Array of records with structure CampaignVideoFields
 type CampaignVideos []CampaignVideoFields
 
-// Instantiate the banner and video objects
-var dbCampaignBanners = CampaignBanners{}
-var dbCampaignVideos = CampaignVideos{}
+// CampaignBudgets - Array of records with structure CampaignBudgetFields
+type CampaignBudgets []CampaignBudgetFields
 
 //
-// Read the rtb4free mysql database and set the banner/vidoe objects.
-func readMySQLTables(mysqlHost string, mysqlDbname string, mysqlUser string, mysqlPassword string) bool {
-	log1 := logger.GetLogger("readMySQLTables")
-	var retError = false
-	var dsn = mysqlUser + ":" + mysqlPassword + "@tcp(" + mysqlHost + ")/" + mysqlDbname
+// Read the campaign records of the rtb4free mysql database into a new snapshot.
+func readCampaignSnapshot(mysqlHost string, mysqlDbname string, mysqlUser string, mysqlPassword string) (*CampaignSnapshot, error) {
+	// Connect and read timeouts, a database that doesn't answer fails the load instead of holding it
+	var dsn = mysqlUser + ":" + mysqlPassword + "@tcp(" + mysqlHost + ")/" + mysqlDbname + "?timeout=10s&readTimeout=30s"
 	db, err := mysqlpkg.Open("mysql", dsn)
 	if err != nil {
-		log1.Error(err.Error())
-		return true
+		return nil, err
 	}
 	defer db.Close()
+	snapshot := &CampaignSnapshot{LoadedAt: time.Now().UTC()}
+
+	iface, err := executeMySQLSelect(db, "select campaigns.id,banners.id as banner_id,campaigns.regions,campaigns.name,campaigns.ad_domain,campaigns.status,campaigns.activate_time,campaigns.expire_time,banners.name,banners.width,banners.height,banners.bid_ecpm from banners, campaigns where banners.campaign_id=campaigns.id AND campaigns.status=\"runnable\"", "campaign_banner") //  c1x table
+	if camprecs, ok := iface.([]CampaignBannerFields); ok && err == nil {
+		snapshot.Banners = camprecs
+	} else {
+		return nil, errors.New("Campaign-Banner records not read")
+	}
 
-	iface, _ := executeMySQLSelect(db, "select campaigns.id,banners.id as banner_id,campaigns.regions from banners, campaigns where banners.campaign_id=campaigns.id AND campaigns.status=\"runnable\"", "campaign_banner") //  c1x table
-	if camprecs, ok := iface.([]CampaignBannerFields); ok {
-		dbCampaignBanners = camprecs
+	iface, err = executeMySQLSelect(db, "select campaigns.id,videos.id as video_id,campaigns.regions,campaigns.name,campaigns.ad_domain,campaigns.status,campaigns.activate_time,campaigns.expire_time,videos.name,videos.vast_video_width,videos.vast_video_height,videos.vast_video_duration,videos.bid_ecpm from banner_videos as videos, campaigns where videos.campaign_id=campaigns.id AND campaigns.status=\"runnable\"", "campaign_video") //  c1x table
+	if camprecs, ok := iface.([]CampaignVideoFields); ok && err == nil {
+		snapshot.Videos = camprecs
 	} else {
-		return true
+		return nil, errors.New("Campaign-Video records not read")
 	}
 
-	iface, _ = executeMySQLSelect(db, "select campaigns.id,videos.id as video_id,campaigns.regions from banner_videos as videos, campaigns where videos.campaign_id=campaigns.id AND campaigns.status=\"runnable\"", "campaign_video") //  c1x table
-	if camprecs, ok := iface.([]CampaignVideoFields); ok {
-		dbCampaignVideos = camprecs
+	iface, err = executeMySQLSelect(db, "select id,total_budget,budget_limit_daily,budget_limit_hourly,activate_time,expire_time from campaigns where status=\"runnable\"", "campaign_budget")
+	if camprecs, ok := iface.([]CampaignBudgetFields); ok && err == nil {
+		snapshot.Budgets = camprecs
 	} else {
-		return true
+		return nil, errors.New("Campaign-Budget records not read")
 	}
 
-	return retError
+	snapshot.index()
+	return snapshot, nil
 }
 
 // Execute an SQL statement
@@ -90,7 +146,8 @@ func executeMySQLSelect(db *mysqlpkg.DB, selectStmt string, rtype string) (inter
 		count := 0
 		for rows.Next() {
 			rec := CampaignBannerFields{}
-			err = rows.Scan(&rec.ID, &rec.BannerID, &rec.Regions)
+			err = rows.Scan(&rec.ID, &rec.BannerID, &rec.Regions, &rec.CampaignName, &rec.AdDomain, &rec.Status, &rec.ActivateTime, &rec.ExpireTime,
+				&rec.Name, &rec.Width, &rec.Height, &rec.BidPrice)
 			if err != nil {
 				log1.Error(err.Error())
 				return rvals, errors.New("Row error on select -" + selectStmt)
@@ -109,7 +166,8 @@ func executeMySQLSelect(db *mysqlpkg.DB, selectStmt string, rtype string) (inter
 		count := 0
 		for rows.Next() {
 			rec := CampaignVideoFields{}
-			err = rows.Scan(&rec.ID, &rec.VideoID, &rec.Regions)
+			err = rows.Scan(&rec.ID, &rec.VideoID, &rec.Regions, &rec.CampaignName, &rec.AdDomain, &rec.Status, &rec.ActivateTime, &rec.ExpireTime,
+				&rec.Name, &rec.Width, &rec.Height, &rec.Duration, &rec.BidPrice)
 			if err != nil {
 				log1.Error(err.Error())
 				return rvals, errors.New("Row error on select -" + selectStmt)
@@ -123,59 +181,44 @@ func executeMySQLSelect(db *mysqlpkg.DB, selectStmt string, rtype string) (inter
 			return rvals, errors.New("Rows error on select -" + selectStmt)
 		}
 		log1.Info(fmt.Sprintf("%d Campaign-Video records read.", count))
+	case "campaign_budget":
+		recs := []CampaignBudgetFields{}
+		count := 0
+		for rows.Next() {
+			rec := CampaignBudgetFields{}
+			err = rows.Scan(&rec.ID, &rec.TotalBudget, &rec.DailyBudget, &rec.HourlyBudget, &rec.ActivateTime, &rec.ExpireTime)
+			if err != nil {
+				log1.Error(err.Error())
+				return rvals, errors.New("Row error on select -" + selectStmt)
+			}
+			recs = append(recs, rec)
+			count++
+		}
+		rvals = recs
+		if err = rows.Err(); err != nil {
+			log1.Error(err.Error())
+			return rvals, errors.New("Rows error on select -" + selectStmt)
+		}
+		log1.Info(fmt.Sprintf("%d Campaign-Budget records read.", count))
 	default:
 		log1.Error("executeMySQLSelect can't find select type - ", rtype)
 	}
 	return rvals, nil
 }
 
-// Find the campaign and creative attributes, given the camp and creative ID
-func findCampaign(campIDint int64, creatIDint int64) CampaignCreativeFields {
-	for _, v := range dbCampaignBanners {
-		if v.ID == creatIDint {
-			return CampaignCreativeFields{
-				Regions: v.Regions,
-			}
-		}
+// Find the campaign and creative attributes, given the camp and creative ID.
+// The ad type of the record picks the creative table if it is banner or video, otherwise
+// banners are looked up before videos. Type is empty if the creative is not found.
+func findCampaign(campIDint int64, creatIDint int64, adType string) CampaignCreativeFields {
+	campaigns := currentCampaigns()
+	types := []string{CreativeBanner, CreativeVideo}
+	if adType == CreativeBanner || adType == CreativeVideo {
+		types = []string{adType}
 	}
-	for _, v := range dbCampaignVideos {
-		if v.ID == creatIDint {
-			return CampaignCreativeFields{
-				Regions: v.Regions,
-			}
+	for _, t := range types {
+		if val, found := campaigns.creatives[creativeKey{t, campIDint, creatIDint}]; found {
+			return val
 		}
 	}
-	if val, found := dbCampaignBanners.findID(campIDint, creatIDint); found {
-		return val
-	}
-	if val, found := dbCampaignVideos.findID(campIDint, creatIDint); found {
-		return val
-	}
 	return CampaignCreativeFields{}
 }
-
-func (campaigns CampaignBanners) findID(ID int64, BannerID int64) (CampaignCreativeFields, bool) {
-	log1 := logger.GetLogger("CampaignBanners findID")
-	log1.Debug(fmt.Sprintf("Look in campaign-banner records for id %d.", ID))
-	for _, v := range campaigns {
-		if v.ID == ID && v.BannerID == BannerID {
-			return CampaignCreativeFields{
-				Regions: v.Regions,
-			}, true
-		}
-	}
-	return CampaignCreativeFields{}, false
-}
-
-func (campaigns CampaignVideos) findID(ID int64, VideoID int64) (CampaignCreativeFields, bool) {
-	log1 := logger.GetLogger("CampaignVideos findID")
-	log1.Info(fmt.Sprintf("Look in campaign-video records for id %d.", ID))
-	for _, v := range campaigns {
-		if v.ID == ID && v.VideoID == VideoID {
-			return CampaignCreativeFields{
-				Regions: v.Regions,
-			}, true
-		}
-	}
-	return CampaignCreativeFields{}, false
-}
@@ -0,0 +1,143 @@
+//
+//  Replay archived event files through the aggregation.
+//  Events from all the files are merged in event time order and intervals are
+//  written as event time moves past them, the same way the ticker writes them
+//  for live data. The merge is deterministic so a replay of the same files always
+//  writes the same records.
+//
+
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+)
+
+// replayHead - next parsed event of one file
+type replayHead struct {
+	reader *eventFileReader
+	topic  TopicBinding
+	field  EventFields
+	index  int // Position of the file in the replay, breaks timestamp ties
+}
+
+// replayHeap - file heads ordered by event timestamp
+type replayHeap []*replayHead
+
+func (h replayHeap) Len() int { return len(h) }
+func (h replayHeap) Less(i, j int) bool {
+	if h[i].field.Timestamp != h[j].field.Timestamp {
+		return h[i].field.Timestamp < h[j].field.Timestamp
+	}
+	return h[i].index < h[j].index
+}
+func (h replayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x interface{}) { *h = append(*h, x.(*replayHead)) }
+func (h *replayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	head := old[n-1]
+	*h = old[:n-1]
+	return head
+}
+
+// Read the next parseable event of the file into the head. Returns false at the end of the file.
+func (head *replayHead) advance() (bool, error) {
+	log1 := logger.GetLogger("replay")
+	for {
+		ev, ok, err := head.reader.next()
+		if err != nil || !ok {
+			return false, err
+		}
+		field, err := parseEvent(head.topic, ev.Value)
+		if err != nil {
+			log1.Error(fmt.Sprintf("%s line %d: %s", head.reader.path, ev.Offset+1, err))
+			rejectEvent(ev, err)
+			continue
+		}
+		head.field = field
+		return true, nil
+	}
+}
+
+// Replay the event files and directories. Files whose topic does not match a rule are skipped.
+func runReplay(paths []string, rules []TopicRule) error {
+	log1 := logger.GetLogger("runReplay")
+	files, err := expandEventPaths(paths)
+	if err != nil {
+		return err
+	}
+	available, _ := newFileSource(files).Topics()
+	topics, err := resolveTopics(rules, available)
+	if err != nil {
+		return err
+	}
+	bindings := make(map[string]TopicBinding)
+	for _, topic := range topics {
+		bindings[topic.Topic] = topic
+	}
+
+	heads := &replayHeap{}
+	for i, path := range files {
+		topic, found := bindings[fileTopic(path)]
+		if !found {
+			log1.Warning(fmt.Sprintf("Skipping %s, topic %s has no rule.", path, fileTopic(path)))
+			continue
+		}
+		reader, err := openEventFile(path, topic.Topic, int32(i))
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		head := &replayHead{reader: reader, topic: topic, index: i}
+		ok, err := head.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Push(heads, head)
+		}
+		log1.Info(fmt.Sprintf("Replaying %s as topic %s (%s events).", path, topic.Topic, topic.Kind))
+	}
+
+	// Events are merged in event time order, so the watermark is the time of the current event
+	// less the allowed lateness. Intervals of each granularity are written as it passes them,
+	// as writeLastInterval does.
+	var events int64
+	writtenMs := make([]int64, len(granularities))
+	for i := range writtenMs {
+		writtenMs[i] = -1
+	}
+	var eventTime time.Time
+	for heads.Len() > 0 {
+		head := (*heads)[0]
+		aggStore.addFields(head.topic.Kind, screenEvent(head.topic, head.field))
+		events++
+		eventTime = time.Unix(0, head.field.Timestamp*int64(time.Millisecond)).UTC()
+		watermarkMs := head.field.Timestamp - int64(lateData.Allowed/time.Millisecond)
+		for i, g := range granularities {
+			if tsMs := completeInterval(g, watermarkMs); tsMs > writtenMs[i] {
+				writeAggregatedRecords(aggStore.collect(g.IntervalStr, tsMs, false), eventTime)
+				writtenMs[i] = tsMs
+			}
+		}
+		for _, w := range windowStores {
+			writeWindows(w, watermarkMs, eventTime)
+		}
+		ok, err := head.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(heads, 0)
+		} else {
+			heap.Pop(heads)
+		}
+	}
+	writeAggregatedRecords(aggStore.collect("", 0, true), eventTime)
+	lateCounts.log()
+	dupCounts.log()
+	log1.Info(fmt.Sprintf("Replayed %d events from %d files.", events, len(files)))
+	return nil
+}
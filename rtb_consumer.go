@@ -7,16 +7,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
-	cluster "github.com/bsm/sarama-cluster"
+	"github.com/Shopify/sarama"
 	log "github.com/go-ozzo/ozzo-log"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
@@ -26,50 +26,95 @@ import (
 //
 var (
 	brokerList        = kingpin.Flag("brokerList", "List of brokers to connect").Default("kafka:9092").String()
-	partition         = kingpin.Flag("partition", "Partition number").Default("0").String()
+	partition         = kingpin.Flag("partition", "Comma separated partition numbers to read with --startTime. All partitions if not set.").String()
 	offsetType        = kingpin.Flag("offsetType", "Offset Type (OffsetNewest | OffsetOldest)").Default("-1").Int()
-	messageCountStart = kingpin.Flag("messageCountStart", "Message counter start from:").Int()
-	// MySQL parameters for accessing campaign manager database
+	messageCountStart = kingpin.Flag("messageCountStart", "Deprecated, not used. Use --startTime to choose where a backfill starts.").String()
+	startTime         = kingpin.Flag("startTime", "Backfill from this time (RFC3339) instead of consuming with the consumer group. Exits after the time range has been written. Must be on an interval boundary.").String()
+	endTime           = kingpin.Flag("endTime", "Backfill up to this time (RFC3339), on an interval boundary. Defaults to the start of the current interval of the longest granularity.").String()
+	eventSource       = kingpin.Flag("eventSource", "Event source (kafka | file)").Default("kafka").Enum("kafka", "file")
+	eventFiles        = kingpin.Flag("eventFiles", "Comma separated NDJSON event files for the file event source. Topic is the file name up to the first \".\".").String()
+	deadLetterSink    = kingpin.Flag("deadLetterSink", "Send rejected messages to file:<path> or kafka:<topic>. Rejected messages are only logged if not set.").String()
+	intervals         = kingpin.Flag("intervals", "Comma separated aggregation intervals, ie 1m,5m,1h,1d.").Default("5m").String()
+	dimensions        = kingpin.Flag("dimensions", "Comma separated dimension sets, each written as its own records. Dimensions of a set are joined by +: campaign, creative, exchange, domain, adtype.").Default("campaign+creative").String()
+	allowedLateness   = kingpin.Flag("allowedLateness", "Event time to wait for late events after an interval ends before writing it.").Default("30s").Duration()
+	latePolicy        = kingpin.Flag("latePolicy", "Events for an interval already written (drop | delta | reemit). delta writes a correction record of the late events, reemit writes the full record again.").Default("drop").Enum(LateDrop, LateDelta, LateReemit)
+	lateHorizon       = kingpin.Flag("lateHorizon", "How long after an interval is written late events are still corrected. Later events are dropped.").Default("1h").Duration()
+	idleTimeout       = kingpin.Flag("idleTimeout", "Partitions without events for this long don't hold back the watermark.").Default("1m").Duration()
+	domainSketches    = kingpin.Flag("domainSketches", "Write the distinct domain sketches in the records, base64 HyperLogLog, to merge them across consumers or intervals.").Bool()
+	topHitters        = kingpin.Flag("topN", "Number of top domains and exchanges by wins and by spend written in each record. 0 for none.").Default("5").Int()
+	joinWindow        = kingpin.Flag("joinWindow", "Event time a bid id is kept to join its win, pixel and click. 0 disables the funnel join.").Default("10m").Duration()
+	joinMaxBids       = kingpin.Flag("joinMaxBids", "Most bid ids kept for the funnel join, the oldest are dropped beyond this.").Default("1000000").Int()
+	dedupWindow       = kingpin.Flag("dedupWindow", "Event time within which an event with the same dedup key is a duplicate. 0 disables dedup.").Default("0s").Duration()
+	dedupKey          = kingpin.Flag("dedupKey", "Dedup key fields joined by +: bidid, campaign, creative, exchange, domain, adtype, timestamp, price, cost.").Default("bidid").String()
+	dedupMaxKeys      = kingpin.Flag("dedupMaxKeys", "Most dedup keys kept, the oldest are dropped beyond this.").Default("1000000").Int()
+	alertSinkSpec     = kingpin.Flag("alertSink", "Send alerts to file:<path> or kafka:<topic>. Alerts are only logged if not set.").String()
+	pacingAlertAt     = kingpin.Flag("pacingAlertAt", "Comma separated percentages of a campaign's total, daily or hourly budget that raise an alert when spent.").Default("80,100").String()
+	pacingTolerance   = kingpin.Flag("pacingTolerance", "Fraction of the daily budget the projected spend may be off and still be on pace.").Default("0.2").Float64()
+	anomalyThreshold  = kingpin.Flag("anomalyThreshold", "Standard deviations from a record's baseline that raise an anomaly alert. 0 disables anomaly detection.").Default("0").Float64()
+	anomalyAlpha      = kingpin.Flag("anomalyAlpha", "Weight of each interval in the rolling anomaly baselines.").Default("0.1").Float64()
+	anomalyWarmup     = kingpin.Flag("anomalyWarmup", "Intervals in a baseline before anomalies are raised against it.").Default("12").Int64()
+	checkpointPath    = kingpin.Flag("checkpointFile", "File to checkpoint the intervals not yet written to, restored on startup. No checkpoints if not set, or with --startTime or the file source.").String()
+	checkpointEvery   = kingpin.Flag("checkpointInterval", "Time between checkpoints.").Default("1m").Duration()
+	windowSpecs       = kingpin.Flag("windows", "Comma separated live windows written every hop, <size>/<hop> for hopping windows, ie 15m/1m, or <size> for sliding windows.").String()
+	windowSlide       = kingpin.Flag("windowSlide", "Hop of the sliding windows.").Default("10s").String()
+	attributes        = kingpin.Flag("attributes", "Comma separated campaign and creative attributes written in each record: campaignName, adDomain, campaignStatus, campaignStart, campaignEnd, creativeName, width, height, videoDuration, creativeBidPrice.").String()
+	topicRules        = kingpin.Flag("topics", "Comma separated topic rules <topic>=<kind>[:<parser>]. Topic may be a /regex/. Kinds: bid, win, pixel, click.").Default("bids=bid,wins=win,pixels=pixel,clicks=click").String()
+	// Kafka TLS and SASL
+	kafkaTLS           = kingpin.Flag("kafkaTLS", "Connect to the brokers with TLS. Implied by the CA, cert and key files.").Bool()
+	kafkaCAFile        = kingpin.Flag("kafkaCAFile", "PEM CA bundle to verify the brokers.").String()
+	kafkaCertFile      = kingpin.Flag("kafkaCertFile", "PEM client certificate.").String()
+	kafkaKeyFile       = kingpin.Flag("kafkaKeyFile", "PEM client key.").String()
+	kafkaSASLMechanism = kingpin.Flag("kafkaSASLMechanism", "SASL mechanism (PLAIN | SCRAM-SHA-256 | SCRAM-SHA-512). No SASL if not set.").String()
+	kafkaUser          = kingpin.Flag("kafkaUser", "SASL user name.").String()
+	kafkaPasswordFile  = kingpin.Flag("kafkaPasswordFile", "File holding the SASL password.").String()
+	// Campaign metadata, and the MySQL parameters for accessing campaign manager database
+	metadataSpec  = kingpin.Flag("metadata", "Read campaign and creative attributes from mysql, file:<path> of JSON or YAML, or an http(s) URL serving JSON.").Default("mysql").String()
+	metadataStart = kingpin.Flag("metadataStart", "If the metadata can't be read by --metadataTimeout at startup (wait | empty | cache). wait exits, empty and cache start degraded without attributes or on the --metadataCache and keep retrying.").Default(MetadataWait).Enum(MetadataWait, MetadataEmpty, MetadataCache)
+	metaTimeout   = kingpin.Flag("metadataTimeout", "How long the metadata is retried at startup, with exponential backoff.").Default("2m").Duration()
+	metadataCache = kingpin.Flag("metadataCache", "File to keep a copy of the last metadata read, to start on with --metadataStart cache.").String()
 	mysqlHost     = kingpin.Flag("mysqlHost", "MySQL database server host name.").Default("web_db").String()
 	mysqlDbname   = kingpin.Flag("mysqlDbname", "MySQL database name.").Default("rtb4free").String()
 	mysqlUser     = kingpin.Flag("mysqlUser", "MySQL database user id.").Default("ben").String()
 	mysqlPassword = kingpin.Flag("mysqlPassword", "MySQL database password.").Default("test").String()
+	mysqlRefresh  = kingpin.Flag("mysqlRefresh", "Time between rereads of the campaign metadata. 0 reads it only at startup.").Default("5m").Duration()
 
-	debug = kingpin.Flag("debug", "Output debug messages.").Bool()
-)
+	debug      = kingpin.Flag("debug", "Output debug messages.").Bool()
+	statusAddr = kingpin.Flag("statusAddr", "Address to serve /health and /ready on, ie :8080. /ready fails while degraded. Not served if not set.").String()
 
-// CountFields - stores message count and time interval of message topic.
-type CountFields struct {
-	lock       *sync.Mutex // Mutex lock to prevent concurrent writes on this counter
-	count      int64       // Count field, increments for each occurrence of the bid, win, pixel, click
-	intervalTs int64       // Epoch time in milleseconds timestamp for the interval.
-	intervalTm time.Time   // Time object timestamp for the interval.
-}
+	// Commands. consume is the default.
+	consumeCmd   = kingpin.Command("consume", "Consume the event source and write the aggregates every interval.").Default()
+	replayCmd    = kingpin.Command("replay", "Aggregate archived NDJSON event files by event time and exit.")
+	replayPaths  = replayCmd.Arg("paths", "Event files or directories. Topic is the file name up to the first \".\". Files may be gzip compressed.").Required().Strings()
+	replayOutput = replayCmd.Flag("output", "File for the aggregation records as NDJSON, - for stdout.").Default("-").String()
+	redriveCmd   = kingpin.Command("redrive", "Re-publish dead letters that now parse to their original topics and exit.")
+	redrivePaths = redriveCmd.Arg("paths", "Dead letter files or directories. Reads the --deadLetterSink kafka topic if not given.").Strings()
+	redriveKeep  = redriveCmd.Flag("remaining", "File for the dead letters that still fail to parse.").String()
+)
 
 // RecordKey - key values to be used as a map key. Will map to CountFields
 // This is the unique identified for the count aggregation - ie, count for each campaign/creative's time interval.
+// Dimensions not in the dimension set are zero.
 type RecordKey struct {
+	Dimensions  string // Name of the dimension set
 	CampaignID  int64
 	CreativeID  int64
+	Exchange    string
+	Domain      string
+	AdType      string
+	Creative    string // Creative type with the creative dimension, banner and video ids are separate
 	IntervalStr string
 	IntervalTs  string
 }
 
-// OutputCounts - Map of unique interval keys to counts
-// Within each interval, this will be created and the count incremented for the unique recordkey
-type OutputCounts map[RecordKey]CountFields
+// Granularity - time interval of the aggregated records, ie 5m.
+// Each granularity is a separate rollup of the same events, written once the watermark passes its intervals.
+type Granularity struct {
+	IntervalStr  string // Interval as configured, set in RecordKey.IntervalStr
+	IntervalSecs int64
+}
 
-// TIme interval for the aggregated record is every 5 minutes
-const intervalStr string = "5m"
-const intervalSecs int64 = 300
-
-// RTB Counters - we want to count bids, wins, pixels and clicks
-var (
-	aggBids   OutputCounts
-	aggWins   OutputCounts
-	aggPixels OutputCounts
-	aggClicks OutputCounts
-)
+// Time intervals of the aggregated records, every 5 minutes unless configured.
+var granularities = []Granularity{{"5m", 300}}
 
 // logger - Create custom logger for each function. Helps debug concurrency.
 var logger *log.Logger
@@ -83,7 +128,10 @@ func main() {
 	defer logger.Close()
 
 	// Set variables from command line
-	kingpin.Parse()
+	command := kingpin.Parse()
+	if command == replayCmd.FullCommand() && *replayOutput == "-" {
+		t1.Writer = os.Stderr // Keep stdout for the records
+	}
 
 	// Override if environment variable defined
 	// We need to override command line if deploying with Docker compose environment variables.
@@ -102,11 +150,162 @@ func main() {
 		}
 	}
 	if v := getEnvValue("messageCountStart"); v != "" {
-		val, err := strconv.Atoi(v)
-		if err == nil {
-			*messageCountStart = val
+		*messageCountStart = v
+	}
+	if *messageCountStart != "" {
+		log1.Warning("messageCountStart is deprecated and not used. Use --startTime to backfill from a time.")
+	}
+	if v := getEnvValue("startTime"); v != "" {
+		*startTime = v
+	}
+	if v := getEnvValue("endTime"); v != "" {
+		*endTime = v
+	}
+	if v := getEnvValue("eventSource"); v != "" {
+		*eventSource = v
+	}
+	if v := getEnvValue("eventFiles"); v != "" {
+		*eventFiles = v
+	}
+	if v := getEnvValue("intervals"); v != "" {
+		*intervals = v
+	}
+	if v := getEnvValue("dimensions"); v != "" {
+		*dimensions = v
+	}
+	if v := getEnvValue("allowedLateness"); v != "" {
+		if val, err := time.ParseDuration(v); err == nil {
+			*allowedLateness = val
+		}
+	}
+	if v := getEnvValue("latePolicy"); v != "" {
+		*latePolicy = v
+	}
+	if v := getEnvValue("lateHorizon"); v != "" {
+		if val, err := time.ParseDuration(v); err == nil {
+			*lateHorizon = val
+		}
+	}
+	if v := getEnvValue("idleTimeout"); v != "" {
+		if val, err := time.ParseDuration(v); err == nil {
+			*idleTimeout = val
+		}
+	}
+	if v := getEnvValue("deadLetterSink"); v != "" {
+		*deadLetterSink = v
+	}
+	if v := getEnvValue("domainSketches"); v != "" {
+		*domainSketches = v == "true" || v == "TRUE"
+	}
+	if v := getEnvValue("topN"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			*topHitters = val
+		}
+	}
+	if v := getEnvValue("joinWindow"); v != "" {
+		if val, err := time.ParseDuration(v); err == nil {
+			*joinWindow = val
+		}
+	}
+	if v := getEnvValue("joinMaxBids"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			*joinMaxBids = val
+		}
+	}
+	if v := getEnvValue("dedupWindow"); v != "" {
+		if val, err := time.ParseDuration(v); err == nil {
+			*dedupWindow = val
+		}
+	}
+	if v := getEnvValue("dedupKey"); v != "" {
+		*dedupKey = v
+	}
+	if v := getEnvValue("dedupMaxKeys"); v != "" {
+		if val, err := strconv.Atoi(v); err == nil {
+			*dedupMaxKeys = val
+		}
+	}
+	if v := getEnvValue("alertSink"); v != "" {
+		*alertSinkSpec = v
+	}
+	if v := getEnvValue("pacingAlertAt"); v != "" {
+		*pacingAlertAt = v
+	}
+	if v := getEnvValue("pacingTolerance"); v != "" {
+		if val, err := strconv.ParseFloat(v, 64); err == nil {
+			*pacingTolerance = val
+		}
+	}
+	if v := getEnvValue("anomalyThreshold"); v != "" {
+		if val, err := strconv.ParseFloat(v, 64); err == nil {
+			*anomalyThreshold = val
+		}
+	}
+	if v := getEnvValue("anomalyAlpha"); v != "" {
+		if val, err := strconv.ParseFloat(v, 64); err == nil {
+			*anomalyAlpha = val
 		}
 	}
+	if v := getEnvValue("anomalyWarmup"); v != "" {
+		if val, err := strconv.ParseInt(v, 10, 64); err == nil {
+			*anomalyWarmup = val
+		}
+	}
+	if v := getEnvValue("checkpointFile"); v != "" {
+		*checkpointPath = v
+	}
+	if v := getEnvValue("checkpointInterval"); v != "" {
+		if val, err := time.ParseDuration(v); err == nil {
+			*checkpointEvery = val
+		}
+	}
+	if v := getEnvValue("windows"); v != "" {
+		*windowSpecs = v
+	}
+	if v := getEnvValue("windowSlide"); v != "" {
+		*windowSlide = v
+	}
+	if v := getEnvValue("attributes"); v != "" {
+		*attributes = v
+	}
+	if v := getEnvValue("topics"); v != "" {
+		*topicRules = v
+	}
+	if v := getEnvValue("kafkaTLS"); v != "" {
+		*kafkaTLS = v == "true" || v == "TRUE"
+	}
+	if v := getEnvValue("kafkaCAFile"); v != "" {
+		*kafkaCAFile = v
+	}
+	if v := getEnvValue("kafkaCertFile"); v != "" {
+		*kafkaCertFile = v
+	}
+	if v := getEnvValue("kafkaKeyFile"); v != "" {
+		*kafkaKeyFile = v
+	}
+	if v := getEnvValue("kafkaSASLMechanism"); v != "" {
+		*kafkaSASLMechanism = v
+	}
+	if v := getEnvValue("kafkaUser"); v != "" {
+		*kafkaUser = v
+	}
+	if v := getEnvValue("kafkaPasswordFile"); v != "" {
+		*kafkaPasswordFile = v
+	}
+	if v := getEnvValue("metadata"); v != "" {
+		*metadataSpec = v
+	}
+	if v := getEnvValue("metadataStart"); v != "" {
+		*metadataStart = v
+	}
+	if v := getEnvValue("metadataTimeout"); v != "" {
+		if val, err := time.ParseDuration(v); err == nil {
+			*metaTimeout = val
+		}
+	}
+	if v := getEnvValue("metadataCache"); v != "" {
+		*metadataCache = v
+	}
 	if v := getEnvValue("mysqlHost"); v != "" {
 		*mysqlHost = v
 	}
@@ -119,6 +318,14 @@ func main() {
 	if v := getEnvValue("mysqlPassword"); v != "" {
 		*mysqlPassword = v
 	}
+	if v := getEnvValue("mysqlRefresh"); v != "" {
+		if val, err := time.ParseDuration(v); err == nil {
+			*mysqlRefresh = val
+		}
+	}
+	if v := getEnvValue("statusAddr"); v != "" {
+		*statusAddr = v
+	}
 	if v := getEnvValue("debug"); v != "" {
 		if v == "true" || v == "TRUE" {
 			*debug = true
@@ -134,23 +341,175 @@ func main() {
 	}
 	log1.Info("Console output level is " + logger.MaxLevel.String())
 	log1.Info(fmt.Sprintf("Looking for kafka brokers: %s", brokers))
-	log1.Info(fmt.Sprintf("Read from db host: %s", *mysqlHost))
+	log1.Info(fmt.Sprintf("Read campaigns from: %s", *metadataSpec))
 
-	// Initialize the counter maps
-	aggBids = OutputCounts{}
-	aggWins = OutputCounts{}
-	aggPixels = OutputCounts{}
-	aggClicks = OutputCounts{}
+	var err2 error
+	granularities, err2 = parseGranularities(strings.Split(*intervals, ","))
+	if err2 != nil {
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
+	dimensionSets, err2 = parseDimensionSets(strings.Split(*dimensions, ","))
+	if err2 != nil {
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
+	switch *latePolicy {
+	case LateDrop, LateDelta, LateReemit:
+	default:
+		err2 = fmt.Errorf("Unknown late policy %q", *latePolicy)
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
+	lateData = LateData{Policy: *latePolicy, Allowed: *allowedLateness, Horizon: *lateHorizon}
+	watermarks = newWatermarks(*idleTimeout)
+	writeSketches = *domainSketches
+	if *topHitters < 0 {
+		err2 = fmt.Errorf("Bad topN %d", *topHitters)
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
+	topN = *topHitters
+	funnelJoin = newFunnelJoin(*joinWindow, *joinMaxBids)
+	dedupFields, err2 := parseDedupFields(*dedupKey)
+	if err2 != nil {
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
+	dedup = newDedup(dedupFields, *dedupWindow, *dedupMaxKeys)
+	alertAt, err2 := parseAlertPercentages(strings.Split(*pacingAlertAt, ","))
+	if err2 != nil {
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
+	pacing = newPacingMonitor(alertAt, *pacingTolerance)
+	if *anomalyAlpha <= 0 || *anomalyAlpha > 1 {
+		err2 = fmt.Errorf("anomalyAlpha %g is not in (0, 1]", *anomalyAlpha)
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
+	anomalies = newAnomalyDetector(*anomalyAlpha, *anomalyThreshold, *anomalyWarmup, anomalyMaxMissing)
+	windows, err2 := parseWindows(strings.Split(*windowSpecs, ","), *windowSlide)
+	if err2 != nil {
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
+	for _, w := range windows {
+		windowStores = append(windowStores, newWindowStore(w, *allowedLateness))
+	}
+	recordAttributes, err2 = parseRecordAttributes(strings.Split(*attributes, ","))
+	if err2 != nil {
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
 
-	// Read the MySQL table to get campaign and creative attributes
-	err := readMySQLTables(*mysqlHost, *mysqlDbname, *mysqlUser, *mysqlPassword)
-	if err {
-		log1.Alert("MySQL error on initial read.")
-		panic("MySQL error on initial read.") // Let docker restart to reread.  Need initial db to be set.
+	// Unknown kinds, parsers or bad patterns in the topic rules stop here.
+	rules, err2 := parseTopicRules(strings.Split(*topicRules, ","))
+	if err2 != nil {
+		log1.Alert(err2.Error())
+		panic(err2)
 	}
 
-	config := cluster.NewConfig()
-	config.Group.Mode = cluster.ConsumerModePartitions
+	if command == redriveCmd.FullCommand() {
+		if err := redrive(brokers, rules); err != nil {
+			log1.Alert(fmt.Sprintf("Redrive failed: %s", err))
+			logger.Close()
+			os.Exit(1)
+		}
+		log1.Info("End redrive")
+		return
+	}
+
+	// Rejected messages go to the dead letter sink
+	kafkaConfig, err2 := newKafkaConfig()
+	if err2 != nil {
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
+	deadLetters, err2 = newJSONSink("Dead letter sink", *deadLetterSink, brokers, kafkaConfig)
+	if err2 != nil {
+		log1.Alert(fmt.Sprintf("Dead letter sink: %s", err2))
+		panic(err2)
+	}
+	if deadLetters != nil {
+		defer deadLetters.Close()
+	}
+	alertSink, err2 = newJSONSink("Alert sink", *alertSinkSpec, brokers, kafkaConfig)
+	if err2 != nil {
+		log1.Alert(fmt.Sprintf("Alert sink: %s", err2))
+		panic(err2)
+	}
+	if alertSink != nil {
+		defer alertSink.Close()
+	}
+
+	// The campaign and creative attributes are read from the metadata provider
+	provider, err2 := newMetadataProvider(*metadataSpec, *mysqlHost, *mysqlDbname, *mysqlUser, *mysqlPassword)
+	if err2 != nil {
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
+	metadataLoader = newMetadataLoader(provider, *metadataCache, *mysqlRefresh)
+
+	// Readiness is reported from here on, degraded until the metadata is read
+	if *statusAddr != "" {
+		if err2 = serveStatus(*statusAddr, metadataLoader); err2 != nil {
+			log1.Alert(fmt.Sprintf("Status endpoint: %s", err2))
+			panic(err2)
+		}
+	}
+
+	// Read the metadata, retrying until the startup timeout
+	err := metadataLoader.start(*metaTimeout, *metadataStart)
+	if err != nil && command == replayCmd.FullCommand() {
+		log1.Warning(fmt.Sprintf("%s. Replay records will not have campaign attributes.", err))
+	} else if err != nil {
+		log1.Alert(err.Error())
+		logger.Close()
+		os.Exit(1)
+	}
+	logCampaignSnapshot()
+
+	if command == replayCmd.FullCommand() {
+		if err := replay(rules); err != nil {
+			log1.Alert(fmt.Sprintf("Replay failed: %s", err))
+			logger.Close()
+			os.Exit(1)
+		}
+		log1.Info("End replay")
+		return
+	}
+
+	source, err2 := newEventSource(brokers)
+	if err2 != nil {
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
+
+	// Resolve the topics to consume.
+	available, err2 := source.Topics()
+	if err2 != nil {
+		log1.Alert(fmt.Sprintf("Can't list topics of %s event source: %s", *eventSource, err2))
+		panic(err2)
+	}
+	topics, err2 := resolveTopics(rules, available)
+	if err2 != nil {
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
+
+	// Continue the intervals of the last checkpoint. A backfill or the file source is a run of its
+	// own, it must not skip events counted by the live consumer nor replace its checkpoint.
+	if *checkpointPath != "" && (*eventSource == "file" || *startTime != "") {
+		log1.Warning(fmt.Sprintf("Checkpoint file %s not used by a backfill or the file source.", *checkpointPath))
+		*checkpointPath = ""
+	}
+	checkpoints = newCheckpointer(*checkpointPath)
+	offsetTracker.finestOnly = checkpoints.enabled()
+	if err2 = checkpoints.restore(); err2 != nil {
+		log1.Alert(err2.Error())
+		panic(err2)
+	}
 
 	// Set up CTL-C to break program
 	signals := make(chan os.Signal, 1)
@@ -160,35 +519,87 @@ func main() {
 
 	// Channel to catch CTL-C
 	doneCh := make(chan struct{})
-	ticker := time.NewTicker(time.Duration(intervalSecs) * time.Second)
+	// One ticker on the finest granularity, at most a minute, writes every granularity whose
+	// intervals the watermark has passed, so a coarse interval is written soon after it completes.
+	// Historical data is written once the source has been read, the wall clock says nothing
+	// about which of its intervals are complete.
+	flushCh := make(chan struct{})
+	windowCh := make(chan *WindowStore)
+	if *eventSource != "file" && *startTime == "" {
+		go func() {
+			every := time.Duration(finestGranularity(granularities).IntervalSecs) * time.Second
+			if every > time.Minute {
+				every = time.Minute
+			}
+			ticker := time.NewTicker(every)
+			for range ticker.C {
+				flushCh <- struct{}{}
+			}
+		}()
+		for _, w := range windowStores {
+			go func(w *WindowStore) {
+				ticker := time.NewTicker(time.Duration(w.window.HopSecs) * time.Second)
+				for range ticker.C {
+					windowCh <- w
+				}
+			}(w)
+		}
+	}
 
-	//Subscribe to Kafka topics
-	go getTopic(config, brokers, []string{"bids"})
-	go getTopic(config, brokers, []string{"wins"})
-	go getTopic(config, brokers, []string{"pixels"})
-	go getTopic(config, brokers, []string{"clicks"})
+	// Checkpoint the intervals not yet written
+	checkpointCh := make(chan struct{})
+	if checkpoints.enabled() && *checkpointEvery > 0 {
+		go func() {
+			ticker := time.NewTicker(*checkpointEvery)
+			for range ticker.C {
+				checkpointCh <- struct{}{}
+			}
+		}()
+	}
+
+	// Reread the campaigns in the background, keeping the last good snapshot, or until read if degraded
+	refreshStop := make(chan struct{})
+	defer close(refreshStop)
+	go metadataLoader.refresh(refreshStop)
+
+	// Channel to catch the end of the event source
+	sourceDone := make(chan error, 1)
+
+	//Subscribe to the topics
+	go func() {
+		sourceDone <- consumeTopics(source, topics)
+	}()
 
-	// Wait for CTL-C. Will kill all go getTopic routines
+	// Wait for CTL-C or the end of the event source.
 	go func() {
 		log1 := logger.GetLogger("main go")
 		for {
 			select {
 			case <-signals:
 				log1.Alert("Interrupt detected")
-				// Drain remaining writes
-				allkeys := make(map[RecordKey]struct{})
-				var tsMs int64
-				setMapKeys(&allkeys, &aggBids, tsMs, true)
-				setMapKeys(&allkeys, &aggWins, tsMs, true) // cost keys are included in win keys
-				setMapKeys(&allkeys, &aggPixels, tsMs, true)
-				setMapKeys(&allkeys, &aggClicks, tsMs, true)
-
-				writeAggregatedRecords(&allkeys)
-				log1.Info("Finished sending remaining writes.")
+				writeAllIntervals(source)
 				doneCh <- struct{}{}
-			case <-ticker.C:
-				log1.Info(fmt.Sprintf("\nTicker at %s.", time.Now()))
-				writeLastInterval()
+			case err := <-sourceDone:
+				if err != nil {
+					log1.Alert(fmt.Sprintf("Event source stopped: %s", err))
+				} else {
+					log1.Info("Event source finished.")
+				}
+				writeAllIntervals(source)
+				doneCh <- struct{}{}
+			case <-flushCh:
+				log1.Debug(fmt.Sprintf("Ticker at %s.", time.Now()))
+				for _, g := range granularities {
+					writeLastInterval(g)
+				}
+			case w := <-windowCh:
+				writeWindows(w, watermarks.watermark(time.Now()), time.Now().UTC())
+			case <-checkpointCh:
+				if err := checkpoints.save(); err != nil {
+					log1.Error(fmt.Sprintf("Checkpoint not saved: %s", err))
+				} else {
+					commitOffsets(nil) // Offsets held since a checkpoint failed
+				}
 			}
 		}
 	}()
@@ -197,36 +608,232 @@ func main() {
 }
 
 //
-// Calculate the aggregated records to be printed by examining the recordKeys.
-// Then print only those records that have expired.
-func writeLastInterval() {
-	log1 := logger.GetLogger("writeLastInterval")
-
-	// Set time value for history
-	tsStr, tsMs, _ := intervalTimestamp(int64(int64(time.Now().Unix())*1000), intervalSecs)
-	log1.Info(fmt.Sprintf("Interval Time stamp string: %s, %d", tsStr, tsMs))
-	allkeys := make(map[RecordKey]struct{})
-	tsMs -= intervalSecs * 1000 // Get the previous interval
+// Kafka client configuration from the command line
+func newKafkaConfig() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.Version = sarama.V1_0_0_0 // Consumer groups need 0.10.2 or later
+	config.Consumer.Offsets.Initial = int64(*offsetType)
+	security := KafkaSecurity{
+		TLS:          *kafkaTLS,
+		CAFile:       *kafkaCAFile,
+		CertFile:     *kafkaCertFile,
+		KeyFile:      *kafkaKeyFile,
+		Mechanism:    *kafkaSASLMechanism,
+		User:         *kafkaUser,
+		PasswordFile: *kafkaPasswordFile,
+	}
+	if err := security.apply(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
 
-	// Get all counters that are ready to print
-	setMapKeys(&allkeys, &aggBids, tsMs, false)
-	setMapKeys(&allkeys, &aggWins, tsMs, false)
-	setMapKeys(&allkeys, &aggPixels, tsMs, false)
-	setMapKeys(&allkeys, &aggClicks, tsMs, false)
+//
+// Create the event source selected on the command line
+func newEventSource(brokers []string) (EventSource, error) {
+	switch *eventSource {
+	case "file":
+		if *eventFiles == "" {
+			return nil, errors.New("File event source needs --eventFiles")
+		}
+		files, err := expandEventPaths(strings.Split(*eventFiles, ","))
+		if err != nil {
+			return nil, err
+		}
+		return newFileSource(files), nil
+	default:
+		config, err := newKafkaConfig()
+		if err != nil {
+			return nil, err
+		}
+		if *startTime == "" {
+			return newKafkaSource(brokers, config)
+		}
+		// Backfill a time range
+		start, err := time.Parse(time.RFC3339, *startTime)
+		if err != nil {
+			return nil, fmt.Errorf("Bad startTime: %s", err)
+		}
+		end := time.Now()
+		if *endTime != "" {
+			if end, err = time.Parse(time.RFC3339, *endTime); err != nil {
+				return nil, fmt.Errorf("Bad endTime: %s", err)
+			}
+		} else {
+			// Intervals still in progress are left out
+			for _, g := range granularities {
+				_, _, end = intervalTimestamp(timeMs(end), g.IntervalSecs)
+			}
+		}
+		if !end.After(start) {
+			return nil, errors.New("endTime must be after startTime")
+		}
+		// Only whole intervals are written: the bounds are on interval boundaries and events
+		// are counted by event time within them. Events arriving up to the allowed lateness
+		// after the end are read.
+		for _, g := range granularities {
+			if timeMs(start)%(g.IntervalSecs*1000) != 0 || timeMs(end)%(g.IntervalSecs*1000) != 0 {
+				return nil, fmt.Errorf("startTime and endTime must be on a %s interval boundary", g.IntervalStr)
+			}
+		}
+		countRange = EventTimeRange{timeMs(start), timeMs(end)}
+		partitions := []int32{}
+		if *partition != "" {
+			for _, v := range strings.Split(*partition, ",") {
+				p, err := strconv.Atoi(strings.TrimSpace(v))
+				if err != nil {
+					return nil, fmt.Errorf("Bad partition %q", v)
+				}
+				partitions = append(partitions, int32(p))
+			}
+		}
+		return newKafkaRangeSource(brokers, config, start, end.Add(*allowedLateness), partitions, "")
+	}
+}
 
-	writeAggregatedRecords(&allkeys)
+//
+// Run the replay command, writing the records to the output file
+func replay(rules []TopicRule) error {
+	if *replayOutput != "-" {
+		f, err := os.Create(*replayOutput)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		recordWriter = newJSONRecordWriter(f)
+	} else {
+		recordWriter = newJSONRecordWriter(os.Stdout)
+	}
+	return runReplay(*replayPaths, rules)
 }
 
 //
-// Look at the recordKey for counters
+// Run the redrive command, reading the dead letters from files or the dead letter topic
+func redrive(brokers []string, rules []TopicRule) error {
+	var source EventSource
+	var topics []string
+	if len(*redrivePaths) > 0 {
+		files, err := expandEventPaths(*redrivePaths)
+		if err != nil {
+			return err
+		}
+		source = newFileSource(files)
+		if topics, err = source.Topics(); err != nil {
+			return err
+		}
+	} else {
+		if !strings.HasPrefix(*deadLetterSink, "kafka:") {
+			return errors.New("redrive needs dead letter files or a --deadLetterSink kafka:<topic>")
+		}
+		config, err := newKafkaConfig()
+		if err != nil {
+			return err
+		}
+		// The redrive group commits the dead letters handled, the next run reads the new ones
+		rangeSource, err := newKafkaRangeSource(brokers, config, time.Unix(0, 0), time.Time{}, nil, kafkaRedriveGroupID)
+		if err != nil {
+			return err
+		}
+		source = rangeSource
+		topics = []string{strings.TrimPrefix(*deadLetterSink, "kafka:")}
+	}
+	defer source.Close()
+
+	var remaining JSONSink
+	if *redriveKeep != "" {
+		var err error
+		if remaining, err = newJSONSink("Redrive keep file", "file:"+*redriveKeep, brokers, nil); err != nil {
+			return err
+		}
+		defer remaining.Close()
+	}
+	config, err := newKafkaConfig()
+	if err != nil {
+		return err
+	}
+	config.Producer.Return.Successes = true // Required by the sync producer
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+	return redriveDeadLetters(source, topics, rules, producer, remaining)
+}
+
 //
-func setMapKeys(set *map[RecordKey]struct{}, mymaps *OutputCounts, tsMs int64, sendAll bool) {
-	for k, fields := range *mymaps {
-		if sendAll || (fields.intervalTs <= tsMs) {
-			(*set)[k] = struct{}{} // only set if timestamp >tsMs
+// Drain remaining writes, acknowledge everything written and close the event source.
+// With checkpoints the intervals in progress are not written, they are saved to the
+// checkpoint and completed after the restart.
+func writeAllIntervals(source EventSource) {
+	log1 := logger.GetLogger("writeAllIntervals")
+	if checkpoints.enabled() {
+		// The offsets counted since the last flush stay unacknowledged, the restart skips them with the checkpoint
+		if err := checkpoints.save(); err != nil {
+			log1.Error(fmt.Sprintf("Checkpoint not saved, intervals in progress are counted again after the restart: %s", err))
+		} else {
+			commitOffsets(nil) // Offsets held since a checkpoint failed
 		}
+	} else {
+		flushLock.Lock()
+		var tsMs int64
+		records := aggStore.collect("", tsMs, true)
+		writeAggregatedRecords(records, time.Now().UTC())
+		offsets := offsetTracker.release("", tsMs, true)
+		flushLock.Unlock()
+		// Acknowledge the offsets of everything written, committed when the source is closed
+		commitOffsets(offsets)
+	}
+	writePacingStatus(time.Now().UTC())
+	rejectCounts.log()
+	lateCounts.log()
+	dupCounts.log()
+	outOfRangeCounts.log()
+	log1.Info("Finished sending remaining writes.")
+	if err := source.Close(); err != nil {
+		log1.Error(fmt.Sprintf("Error closing event source: %s", err))
+	}
+}
+
+//
+// Calculate the aggregated records to be printed by examining the recordKeys.
+// Then print only those records of the granularity that the watermark has passed.
+func writeLastInterval(g Granularity) {
+	log1 := logger.GetLogger("writeLastInterval")
+
+	// Latest complete interval at the event time watermark
+	watermarkMs := watermarks.watermark(time.Now())
+	tsMs := completeInterval(g, watermarkMs)
+	if written, found := aggStore.writtenTo(g.IntervalStr); found && tsMs <= written {
+		return
+	}
+	log1.Info(fmt.Sprintf("Watermark %s, writing %s intervals to %d", time.Unix(0, watermarkMs*int64(time.Millisecond)).UTC().Format(time.RFC3339), g.IntervalStr, tsMs))
+
+	// Stop counting while the intervals are written and their offsets released
+	flushLock.Lock()
+	// Get all counters that are ready to print
+	records := aggStore.collect(g.IntervalStr, tsMs, false)
+	writeAggregatedRecords(records, time.Now().UTC())
+	offsets := offsetTracker.release(g.IntervalStr, tsMs, false)
+	cp := checkpoints.capture()
+	flushLock.Unlock()
+	writePacingStatus(time.Now().UTC())
+
+	// The checkpoint of the intervals written replaces the previous one before their offsets are
+	// acknowledged, so a restart doesn't restore and write them again. If it can't be saved the
+	// previous one still matches the offsets acknowledged, and the offsets wait for the next one.
+	if err := checkpoints.write(cp); err != nil {
+		log1.Error(fmt.Sprintf("Checkpoint not saved, offsets held until the next one is: %s", err))
+		holdOffsets(offsets)
+	} else {
+		// Messages in the written intervals can now be marked as processed
+		commitOffsets(offsets)
 	}
-	return
+	rejectCounts.log()
+	lateCounts.log()
+	dupCounts.log()
+	dedup.log()
+	funnelJoin.log()
+	logCampaignSnapshot()
 }
 
 //
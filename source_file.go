@@ -0,0 +1,205 @@
+//
+//  Event source reading newline delimited JSON event files.
+//  Each line is one message value. The topic is the file name up to the first ".",
+//  ie, bids.ndjson or bids.2018-01-01.json.gz are read as topic bids.
+//  Gzip compressed files are decompressed as they are read.
+//  Each file is a partition, the offset is the line number in the file.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileSource - event source over a list of NDJSON files
+type FileSource struct {
+	files []string
+	done  chan struct{}
+	once  *sync.Once
+}
+
+func newFileSource(files []string) *FileSource {
+	return &FileSource{
+		files: files,
+		done:  make(chan struct{}),
+		once:  new(sync.Once),
+	}
+}
+
+// Topic of an event file, from its name
+func fileTopic(path string) string {
+	name := filepath.Base(path)
+	if dot := strings.Index(name, "."); dot > 0 {
+		name = name[:dot]
+	}
+	return name
+}
+
+// Topics returns the topics of the files
+func (s *FileSource) Topics() ([]string, error) {
+	topics := []string{}
+	for _, path := range s.files {
+		if topic := fileTopic(path); !containsString(topics, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// Consume reads every file of the topics and returns when all have been read
+func (s *FileSource) Consume(topics []string, handler func(Event)) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(s.files))
+	for i, path := range s.files {
+		topic := fileTopic(path)
+		if !containsString(topics, topic) {
+			continue
+		}
+		wg.Add(1)
+		go func(path string, topic string, partition int32) {
+			defer wg.Done()
+			if err := s.readFile(path, topic, partition, handler); err != nil {
+				errs <- err
+			}
+		}(path, topic, int32(i))
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs // First error, nil if none
+}
+
+// Read one file, one event per line
+func (s *FileSource) readFile(path string, topic string, partition int32, handler func(Event)) error {
+	log1 := logger.GetLogger("FileSource readFile")
+	r, err := openEventFile(path, topic, partition)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	log1.Info(fmt.Sprintf("Reading %s as topic %s partition %d.", path, topic, partition))
+	for {
+		select {
+		case <-s.done:
+			return nil
+		default:
+		}
+		ev, ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		handler(ev)
+	}
+}
+
+// eventFileReader - reads the events of one file in order
+type eventFileReader struct {
+	path      string
+	topic     string
+	partition int32
+	offset    int64
+	file      *os.File
+	gz        *gzip.Reader
+	reader    *bufio.Reader
+}
+
+// Open an event file. Gzip compressed files are detected from their header.
+func openEventFile(path string, topic string, partition int32) (*eventFileReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &eventFileReader{
+		path:      path,
+		topic:     topic,
+		partition: partition,
+		file:      f,
+		reader:    bufio.NewReader(f),
+	}
+	if magic, err := r.reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		if r.gz, err = gzip.NewReader(r.reader); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		r.reader = bufio.NewReader(r.gz)
+	}
+	return r, nil
+}
+
+// Next event in the file. Returns false at the end of the file.
+func (r *eventFileReader) next() (Event, bool, error) {
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		offset := r.offset
+		r.offset++
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return Event{
+				Topic:     r.topic,
+				Partition: r.partition,
+				Offset:    offset,
+				Value:     line,
+			}, true, nil
+		}
+		if err == io.EOF {
+			return Event{}, false, nil
+		}
+		if err != nil {
+			return Event{}, false, fmt.Errorf("%s line %d: %s", r.path, r.offset, err)
+		}
+	}
+}
+
+// Close the file
+func (r *eventFileReader) Close() error {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	return r.file.Close()
+}
+
+// Expand directories to the files they contain, in name order, including sub directories.
+func expandEventPaths(paths []string) ([]string, error) {
+	files := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Close stops reading the files
+func (s *FileSource) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
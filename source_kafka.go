@@ -0,0 +1,311 @@
+//
+//  Event source reading the Kafka topics with a sarama consumer group.
+//  Acknowledging an event marks its offset on the group session, sarama commits
+//  the marked offsets in the background and on Close.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// Consumer group used for the RTB topics
+const kafkaGroupID = "rtb-consumer-group-1"
+
+// Consumer group committing the dead letters re-driven
+const kafkaRedriveGroupID = "rtb-consumer-redrive-1"
+
+// KafkaSource - event source over a sarama consumer group
+type KafkaSource struct {
+	client sarama.Client
+	group  sarama.ConsumerGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// kafkaGroupHandler - sarama.ConsumerGroupHandler passing each message on as an Event
+type kafkaGroupHandler struct {
+	handler func(Event)
+}
+
+func newKafkaSource(brokers []string, config *sarama.Config) (*KafkaSource, error) {
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	group, err := sarama.NewConsumerGroupFromClient(kafkaGroupID, client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &KafkaSource{
+		client: client,
+		group:  group,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// Topics returns the topics on the brokers
+func (s *KafkaSource) Topics() ([]string, error) {
+	return s.client.Topics()
+}
+
+// Consume joins the group for the topics. Rejoins after each rebalance until Close.
+func (s *KafkaSource) Consume(topics []string, handler func(Event)) error {
+	log1 := logger.GetLogger("KafkaSource Consume")
+	go func() {
+		for err := range s.group.Errors() {
+			log1.Error(err.Error())
+		}
+	}()
+	for {
+		if err := s.group.Consume(s.ctx, topics, &kafkaGroupHandler{handler}); err != nil {
+			return err
+		}
+		if s.ctx.Err() != nil {
+			return nil
+		}
+		log1.Info(fmt.Sprintf("Rebalance of topics %s.", topics))
+	}
+}
+
+// Close leaves the group, committing the marked offsets
+func (s *KafkaSource) Close() error {
+	s.cancel()
+	if err := s.group.Close(); err != nil {
+		s.client.Close()
+		return err
+	}
+	return s.client.Close()
+}
+
+// Setup is run at the beginning of a new session, before ConsumeClaim
+func (h *kafkaGroupHandler) Setup(sess sarama.ConsumerGroupSession) error {
+	log1 := logger.GetLogger("kafkaGroupHandler Setup")
+	log1.Info(fmt.Sprintf("Consumer group session %d claims %v.", sess.GenerationID(), sess.Claims()))
+	return nil
+}
+
+// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
+func (h *kafkaGroupHandler) Cleanup(sess sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim reads the messages of one partition
+func (h *kafkaGroupHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		m := msg
+		h.handler(Event{
+			Topic:     m.Topic,
+			Partition: m.Partition,
+			Offset:    m.Offset,
+			Key:       m.Key,
+			Value:     m.Value,
+			Timestamp: m.Timestamp,
+			Ack:       func() { sess.MarkMessage(m, "") },
+		})
+	}
+	return nil
+}
+
+// KafkaRangeSource - event source reading the Kafka topics between two times, without a
+// consumer group. The start offset of each partition is the first message at or after the
+// start time. Reading stops at the first message at or after the end time, or at the end of
+// the partition when reading started. Used to recompute a reporting window, nothing is acknowledged.
+// With a group, reading resumes after the offsets committed by the group and acknowledged
+// events are committed on Close, so each message is read by one run of the group.
+type KafkaRangeSource struct {
+	client     sarama.Client
+	consumer   sarama.Consumer
+	offsets    sarama.OffsetManager // Offsets of the group, nil if none
+	start      time.Time
+	end        time.Time // Zero to read to the end of the partition
+	partitions []int32   // Partitions to read, all if empty
+	done       chan struct{}
+	once       *sync.Once
+}
+
+func newKafkaRangeSource(brokers []string, config *sarama.Config, start time.Time, end time.Time, partitions []int32, group string) (*KafkaRangeSource, error) {
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	var offsets sarama.OffsetManager
+	if group != "" {
+		if offsets, err = sarama.NewOffsetManagerFromClient(group, client); err != nil {
+			consumer.Close()
+			client.Close()
+			return nil, err
+		}
+	}
+	return &KafkaRangeSource{
+		client:     client,
+		consumer:   consumer,
+		offsets:    offsets,
+		start:      start,
+		end:        end,
+		partitions: partitions,
+		done:       make(chan struct{}),
+		once:       new(sync.Once),
+	}, nil
+}
+
+// Topics returns the topics on the brokers
+func (s *KafkaRangeSource) Topics() ([]string, error) {
+	return s.client.Topics()
+}
+
+// Consume reads the time range of every partition of the topics and returns when all have been read
+func (s *KafkaRangeSource) Consume(topics []string, handler func(Event)) error {
+	log1 := logger.GetLogger("KafkaRangeSource Consume")
+	var wg sync.WaitGroup
+	errs := make(chan error, 1)
+	for _, topic := range topics {
+		partitions, err := s.client.Partitions(topic)
+		if err != nil {
+			return err
+		}
+		for _, partition := range partitions {
+			if len(s.partitions) > 0 && !containsPartition(s.partitions, partition) {
+				continue
+			}
+			first, last, err := s.offsetRange(topic, partition)
+			if err != nil {
+				return err
+			}
+			var pom sarama.PartitionOffsetManager
+			if s.offsets != nil {
+				if pom, err = s.offsets.ManagePartition(topic, partition); err != nil {
+					return err
+				}
+				if next, _ := pom.NextOffset(); next > first {
+					first = next // Read by an earlier run
+				}
+			}
+			if first > last {
+				log1.Info(fmt.Sprintf("%s/%d has no messages in the time range.", topic, partition))
+				continue
+			}
+			log1.Info(fmt.Sprintf("%s/%d reading offsets %d to %d.", topic, partition, first, last))
+			pc, err := s.consumer.ConsumePartition(topic, partition, first)
+			if err != nil {
+				return err
+			}
+			wg.Add(1)
+			go func(pc sarama.PartitionConsumer, pom sarama.PartitionOffsetManager, last int64) {
+				defer wg.Done()
+				defer pc.Close()
+				for {
+					select {
+					case <-s.done:
+						return
+					case msg, ok := <-pc.Messages():
+						if !ok {
+							return // Consumer closed
+						}
+						h := msg
+						if h.Offset > last {
+							return
+						}
+						ev := Event{
+							Topic:     h.Topic,
+							Partition: h.Partition,
+							Offset:    h.Offset,
+							Key:       h.Key,
+							Value:     h.Value,
+							Timestamp: h.Timestamp,
+						}
+						if pom != nil {
+							ev.Ack = func() { pom.MarkOffset(h.Offset+1, "") }
+						}
+						handler(ev)
+						if h.Offset >= last {
+							return
+						}
+					case err := <-pc.Errors():
+						select {
+						case errs <- err:
+						default:
+						}
+						return
+					}
+				}
+			}(pc, pom, last)
+		}
+	}
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// First and last offset of a partition in the time range
+func (s *KafkaRangeSource) offsetRange(topic string, partition int32) (int64, int64, error) {
+	newest, err := s.client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, 0, err
+	}
+	first, err := s.client.GetOffset(topic, partition, timeMs(s.start))
+	if err != nil {
+		return 0, 0, err
+	}
+	if first < 0 {
+		first = newest // No message at or after the start time
+	}
+	end := newest
+	if !s.end.IsZero() {
+		if end, err = s.client.GetOffset(topic, partition, timeMs(s.end)); err != nil {
+			return 0, 0, err
+		}
+		if end < 0 || end > newest {
+			end = newest
+		}
+	}
+	return first, end - 1, nil
+}
+
+// Close stops reading the partitions, committing the acknowledged offsets of the group
+func (s *KafkaRangeSource) Close() error {
+	log1 := logger.GetLogger("KafkaRangeSource Close")
+	s.once.Do(func() { close(s.done) })
+	if s.offsets != nil {
+		if err := s.offsets.Close(); err != nil {
+			log1.Error(fmt.Sprintf("Error committing offsets: %s", err))
+		}
+	}
+	if err := s.consumer.Close(); err != nil {
+		s.client.Close()
+		return err
+	}
+	return s.client.Close()
+}
+
+func containsPartition(list []int32, partition int32) bool {
+	for _, v := range list {
+		if v == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// Epoch milliseconds of a time
+func timeMs(tm time.Time) int64 {
+	return tm.UnixNano() / int64(time.Millisecond)
+}
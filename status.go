@@ -0,0 +1,39 @@
+//
+//  Status endpoint for container probes. /health answers while the process runs,
+//  /ready answers 503 with the reason while the consumer is degraded.
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Serve the status endpoint on the address, ie :8080, with the readiness of the metadata loader
+func serveStatus(addr string, loader *MetadataLoader) error {
+	log1 := logger.GetLogger("serveStatus")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		ready, reason := loader.ready()
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintln(w, reason)
+	})
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log1.Error(fmt.Sprintf("Status endpoint stopped: %s", err))
+		}
+	}()
+	log1.Info(fmt.Sprintf("Serving /health and /ready on %s", addr))
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubMetadata - metadata provider returning a fixed snapshot, or an error
+type stubMetadata struct {
+	campaigns MetadataCampaigns
+	err       error
+}
+
+func (p *stubMetadata) Load() (*CampaignSnapshot, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.campaigns.snapshot(), nil
+}
+
+func (p *stubMetadata) String() string {
+	return "stub"
+}
+
+// /ready follows the loader it is served for, from degraded to ready
+func TestServeStatusReady(t *testing.T) {
+	defer swapCampaigns(currentCampaigns())
+	swapCampaigns(&CampaignSnapshot{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	provider := &stubMetadata{err: errors.New("down")}
+	loader := newMetadataLoader(provider, "", 0)
+	if err := serveStatus(addr, loader); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	if code, _ := get("/health"); code != http.StatusOK {
+		t.Fatalf("/health answered %d", code)
+	}
+	loader.load()
+	if code, reason := get("/ready"); code != http.StatusServiceUnavailable || !strings.Contains(reason, "down") {
+		t.Fatalf("/ready answered %d %q while the provider is down", code, reason)
+	}
+	provider.err = nil
+	if err := loader.load(); err != nil {
+		t.Fatal(err)
+	}
+	if code, reason := get("/ready"); code != http.StatusOK {
+		t.Fatalf("/ready answered %d %q once loaded", code, reason)
+	}
+}
+
+// hangingMetadata - metadata provider that doesn't answer until released
+type hangingMetadata struct {
+	release chan struct{}
+}
+
+func (p *hangingMetadata) Load() (*CampaignSnapshot, error) {
+	<-p.release
+	return nil, errors.New("released")
+}
+
+func (p *hangingMetadata) String() string {
+	return "hanging"
+}
+
+// A provider that doesn't answer is given up at the startup timeout, then the start policy applies
+func TestMetadataStartTimeout(t *testing.T) {
+	defer swapCampaigns(currentCampaigns())
+	provider := &hangingMetadata{release: make(chan struct{})}
+	defer close(provider.release)
+	loader := newMetadataLoader(provider, "", 0)
+
+	began := time.Now()
+	err := loader.start(100*time.Millisecond, MetadataWait)
+	if err == nil {
+		t.Fatal("Started without metadata with the wait policy")
+	}
+	if elapsed := time.Since(began); elapsed > time.Second {
+		t.Fatalf("Start returned after %s, want the 100ms timeout", elapsed)
+	}
+	if err := loader.start(100*time.Millisecond, MetadataEmpty); err != nil {
+		t.Fatal(err)
+	}
+	if !currentCampaigns().Degraded {
+		t.Fatal("Started without metadata, not degraded")
+	}
+}
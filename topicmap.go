@@ -0,0 +1,191 @@
+//
+//  Map Kafka topics to the event kind they carry and the parser for their messages.
+//  Rules are given as <topic>=<kind>[:<parser>], where the topic may be a /regex/,
+//  and are resolved to concrete topic names once at startup.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// EventParser - decode a message value into the event fields used for aggregation
+type EventParser func(msg []byte) (EventFields, error)
+
+// eventKindNames - event kinds by configuration name
+var eventKindNames = map[string]EventKind{
+	"bid":   KindBid,
+	"win":   KindWin,
+	"pixel": KindPixel,
+	"click": KindClick,
+}
+
+// eventParsers - message parsers by configuration name.
+// Each event kind has a default parser of the same name.
+var eventParsers = map[string]EventParser{
+	"bid":   parseBid,
+	"win":   parseWin,
+	"pixel": parsePixel,
+	"click": parseClick,
+}
+
+// TopicRule - maps a topic name or pattern to an event kind and parser
+type TopicRule struct {
+	Pattern string         // Topic name, or regex if regex is set
+	regex   *regexp.Regexp // Compiled pattern for /regex/ rules
+	Kind    EventKind      // Event kind of the messages on the topic
+	Parser  string         // Name of the parser in eventParsers
+}
+
+// TopicBinding - a concrete topic resolved from the rules
+type TopicBinding struct {
+	Topic  string
+	Kind   EventKind
+	Parser string
+	parse  EventParser
+}
+
+func (k EventKind) String() string {
+	for name, kind := range eventKindNames {
+		if kind == k {
+			return name
+		}
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// Parse the topic rules. Any unknown kind or parser, or bad regex, is an error.
+func parseTopicRules(specs []string) ([]TopicRule, error) {
+	rules := []TopicRule{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		eq := strings.LastIndex(spec, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("Topic rule %q is not <topic>=<kind>[:<parser>]", spec)
+		}
+		rule := TopicRule{Pattern: spec[:eq]}
+		kindName := spec[eq+1:]
+		parserName := kindName
+		if colon := strings.Index(kindName, ":"); colon >= 0 {
+			kindName, parserName = kindName[:colon], kindName[colon+1:]
+		}
+		kind, found := eventKindNames[kindName]
+		if !found {
+			return nil, fmt.Errorf("Topic rule %q has unknown event kind %q", spec, kindName)
+		}
+		if _, found := eventParsers[parserName]; !found {
+			return nil, fmt.Errorf("Topic rule %q has unknown parser %q", spec, parserName)
+		}
+		rule.Kind = kind
+		rule.Parser = parserName
+		if len(rule.Pattern) > 2 && strings.HasPrefix(rule.Pattern, "/") && strings.HasSuffix(rule.Pattern, "/") {
+			rule.Pattern = rule.Pattern[1 : len(rule.Pattern)-1]
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Topic rule %q: %s", spec, err)
+			}
+			rule.regex = re
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("No topic rules configured")
+	}
+	return rules, nil
+}
+
+// Resolve the rules to concrete topics. available is the broker's topic list, used to expand
+// the regex rules. A topic matched by rules with different kinds or parsers is an error.
+func resolveTopics(rules []TopicRule, available []string) ([]TopicBinding, error) {
+	log1 := logger.GetLogger("resolveTopics")
+	bindings := map[string]TopicBinding{}
+	bind := func(topic string, rule TopicRule) error {
+		if b, found := bindings[topic]; found {
+			if b.Kind != rule.Kind || b.Parser != rule.Parser {
+				return fmt.Errorf("Topic %s matches rules for both %s:%s and %s:%s", topic, b.Kind, b.Parser, rule.Kind, rule.Parser)
+			}
+			return nil
+		}
+		bindings[topic] = TopicBinding{
+			Topic:  topic,
+			Kind:   rule.Kind,
+			Parser: rule.Parser,
+			parse:  eventParsers[rule.Parser],
+		}
+		return nil
+	}
+	for _, rule := range rules {
+		if rule.regex == nil {
+			if available != nil && !containsString(available, rule.Pattern) {
+				log1.Warning(fmt.Sprintf("Topic %s not found on brokers.", rule.Pattern))
+			}
+			if err := bind(rule.Pattern, rule); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		matched := 0
+		for _, topic := range available {
+			if rule.regex.MatchString(topic) {
+				if err := bind(topic, rule); err != nil {
+					return nil, err
+				}
+				matched++
+			}
+		}
+		if matched == 0 {
+			log1.Warning(fmt.Sprintf("Topic pattern /%s/ matches no topics.", rule.Pattern))
+		}
+	}
+	if len(bindings) == 0 {
+		return nil, errors.New("Topic rules match no topics")
+	}
+	resolved := make([]TopicBinding, 0, len(bindings))
+	for _, b := range bindings {
+		resolved = append(resolved, b)
+	}
+	sort.Slice(resolved, func(i, j int) bool { return resolved[i].Topic < resolved[j].Topic })
+	return resolved, nil
+}
+
+// Find the binding of one topic. Error if no rule, or conflicting rules, match it.
+func bindTopic(rules []TopicRule, topic string) (TopicBinding, error) {
+	var binding TopicBinding
+	found := false
+	for _, rule := range rules {
+		if (rule.regex == nil && rule.Pattern != topic) || (rule.regex != nil && !rule.regex.MatchString(topic)) {
+			continue
+		}
+		if found && (binding.Kind != rule.Kind || binding.Parser != rule.Parser) {
+			return TopicBinding{}, fmt.Errorf("Topic %s matches rules for both %s:%s and %s:%s", topic, binding.Kind, binding.Parser, rule.Kind, rule.Parser)
+		}
+		binding = TopicBinding{
+			Topic:  topic,
+			Kind:   rule.Kind,
+			Parser: rule.Parser,
+			parse:  eventParsers[rule.Parser],
+		}
+		found = true
+	}
+	if !found {
+		return TopicBinding{}, fmt.Errorf("No topic rule for %s", topic)
+	}
+	return binding, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
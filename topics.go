@@ -1,4 +1,4 @@
-//  Subscribe to the Kafka topics and read the JSON messages.
+//  Read the JSON messages of the topics from the event source.
 //  Create a counter entry for the timestamp and increment for each bid, win, pixel, click message.
 //
 
@@ -6,37 +6,37 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"sync"
 	"time"
-
-	cluster "github.com/bsm/sarama-cluster"
 )
 
-// BidFields - message format of Kafka bids topic
+// BidFields - message format of the bids topic
 type BidFields struct {
-	CampaignID int64   `json:"adid,string"`
-	CreativeID int64   `json:"crid,string"`
-	AdType     string  `json:"adtype"`
-	Domain     string  `json:"domain"`
-	Exchange   string  `json:"exchange"`
-	Cost       float64 `json:"cost"`
-	Timestamp  int64   `json:"timestamp"`
+	CampaignID int64  `json:"adid,string"`
+	CreativeID int64  `json:"crid,string"`
+	AdType     string `json:"adtype"`
+	Domain     string `json:"domain"`
+	Exchange   string `json:"exchange"`
+	Cost       Micros `json:"cost"` // Bid price
+	Timestamp  int64  `json:"timestamp"`
+	BidID      string `json:"oidStr"`
 }
 
-// WinFields - message format of Kafka wins topic
+// WinFields - message format of the wins topic
 type WinFields struct {
-	CampaignID int64   `json:"adId,string"`
-	CreativeID int64   `json:"cridId,string"`
-	AdType     string  `json:"adtype"`
-	Exchange   string  `json:"pubId"`
-	Cost       float64 `json:"cost,string"`
-	Price      float64 `json:"price,string"`
-	Timestamp  int64   `json:"timestamp"`
-	Domain     string  `json:"domain"`
+	CampaignID int64  `json:"adId,string"`
+	CreativeID int64  `json:"cridId,string"`
+	AdType     string `json:"adtype"`
+	Exchange   string `json:"pubId"`
+	Cost       Micros `json:"cost"`  // Quoted decimal
+	Price      Micros `json:"price"` // Clearing price, quoted decimal
+	Timestamp  int64  `json:"timestamp"`
+	Domain     string `json:"domain"`
+	BidID      string `json:"hash"`
 }
 
-// PixelFields - message format of Kafka pixels topic
+// PixelFields - message format of the pixels topic
 type PixelFields struct {
 	CampaignID int64  `json:"ad_id,string"`
 	CreativeID int64  `json:"creative_id,string"`
@@ -44,9 +44,10 @@ type PixelFields struct {
 	Exchange   string `json:"exchange"`
 	Timestamp  int64  `json:"timestamp"`
 	Domain     string `json:"domain"`
+	BidID      string `json:"bid_id"`
 }
 
-// ClickFields - message format of Kafka clicks topic
+// ClickFields - message format of the clicks topic
 type ClickFields struct {
 	CampaignID int64  `json:"ad_id,string"`
 	CreativeID int64  `json:"creative_id,string"`
@@ -54,132 +55,213 @@ type ClickFields struct {
 	Exchange   string `json:"exchange"`
 	Timestamp  int64  `json:"timestamp"`
 	Domain     string `json:"domain"`
+	BidID      string `json:"bid_id"`
+}
+
+// EventFields - fields common to all the event messages, used for aggregation
+type EventFields struct {
+	CampaignID int64
+	CreativeID int64
+	AdType     string
+	Domain     string
+	Exchange   string
+	Price      Micros // Bid price of bids, clearing price of wins
+	Cost       Micros // Cost of wins
+	Timestamp  int64
+	BidID      string // RTB4FREE bid id, joins the bid to its win, pixel and click
+	Joined     bool   // Set by the funnel join if the previous step of the bid id was seen
+	LatencyMs  int64  // Event time since the previous step, if joined
+	Duplicate  bool   // Set by the dedup stage, the event is counted as a duplicate only
+}
+
+// EventTimeRange - event times counted, [StartMs, EndMs) in epoch milliseconds. Everything if EndMs is 0.
+type EventTimeRange struct {
+	StartMs int64
+	EndMs   int64
+}
+
+// Event times counted, set for a backfill so only the intervals of its time range are written
+var countRange = EventTimeRange{}
+
+// Events outside the time range, read from the source but not counted
+var outOfRangeCounts = newEventCounts("Events outside the time range")
+
+func (r EventTimeRange) contains(tsMs int64) bool {
+	return r.EndMs == 0 || (tsMs >= r.StartMs && tsMs < r.EndMs)
 }
 
-// Separate go routine for each topic
-func getTopic(config *cluster.Config, brokers []string, topics []string) {
-	log1 := logger.GetLogger("getTopic")
-	log1.Info("Connect to brokers ", brokers, " topics ", topics)
-	consumer, err2 := cluster.NewConsumer(brokers, "rtb-consumer-group-1", topics, config)
-	if err2 != nil {
-		log1.Alert(err2.Error())
-		panic(err2)
+// Consume the topics from the event source and count each event.
+// Returns when the source is closed or exhausted.
+func consumeTopics(source EventSource, topics []TopicBinding) error {
+	log1 := logger.GetLogger("consumeTopics")
+	bindings := make(map[string]TopicBinding)
+	names := []string{}
+	for _, topic := range topics {
+		log1.Info(fmt.Sprintf("Consume topic %s (%s events, %s parser)", topic.Topic, topic.Kind, topic.Parser))
+		bindings[topic.Topic] = topic
+		names = append(names, topic.Topic)
 	}
-	//defer consumer.Close()
-	go func() {
-		log1 := logger.GetLogger("getTopic go func")
-		for {
-			select {
-			case part, ok := <-consumer.Partitions():
-				if !ok {
-					log1.Error("consumer.Partions error.")
-					return
-				}
-				// start a separate goroutine to consume messages
-				go func(pc cluster.PartitionConsumer) {
-					log1 := logger.GetLogger("getTopic kafka partition")
-					for msg := range pc.Messages() {
-						log1.Debug(fmt.Sprintf("%s/%d/%d\t%s\t%s", msg.Topic, msg.Partition, msg.Offset, msg.Key, msg.Value))
-						switch msg.Topic {
-						case "bids":
-							aggBids.addCount(msg.Topic, msg.Value)
-						case "wins":
-							aggWins.addCount(msg.Topic, msg.Value)
-						case "pixels":
-							aggPixels.addCount(msg.Topic, msg.Value)
-						case "clicks":
-							aggClicks.addCount(msg.Topic, msg.Value)
-						default:
-							log1.Alert(fmt.Sprintf("Unexpected topic %s.", msg.Topic))
-							return
-						}
-						consumer.MarkOffset(msg, "") // mark message as processed
-					}
-				}(part)
+	return source.Consume(names, func(ev Event) {
+		countEvent(bindings, ev)
+	})
+}
+
+// Count one event. Called concurrently for different partitions.
+func countEvent(bindings map[string]TopicBinding, ev Event) {
+	log1 := logger.GetLogger("countEvent")
+	log1.Debug(fmt.Sprintf("%s/%d/%d\t%s\t%s", ev.Topic, ev.Partition, ev.Offset, ev.Key, ev.Value))
+	var intervals []int64
+	var err error
+	flushLock.RLock() // Hold off the flush until the offset is tracked
+	// Events in the restored counters, or redelivered by the source, are tracked but not counted again
+	restored := checkpoints.counted(ev) || offsetTracker.counted(ev)
+	if topic, found := bindings[ev.Topic]; found {
+		var field EventFields
+		if field, err = parseEvent(topic, ev.Value); err == nil {
+			watermarks.observe(ev.Topic, ev.Partition, field.Timestamp, time.Now())
+			if restored {
+				// Already counted, its offset is released with the intervals
+				intervals = restoredIntervals(field)
+			} else if !countRange.contains(field.Timestamp) {
+				outOfRangeCounts.add(ev.Topic)
+			} else {
+				intervals = aggStore.addFields(topic.Kind, screenEvent(topic, field))
 			}
 		}
-	}()
-	return
-}
-
-// Update counters
-func (agg OutputCounts) addCount(topic string, msg []byte) {
-	log1 := logger.GetLogger("addCount")
-	var key RecordKey
-	var ts string
-	var tsMs int64
-	var tm time.Time
-	switch topic {
-	case "bids":
-		field := BidFields{}
-		if err := json.Unmarshal(msg, &field); err != nil {
-			logger.Error(fmt.Sprintf("JSON unmarshaling failed: %s", err))
-			return
-		}
-		ts, tsMs, tm = intervalTimestamp(field.Timestamp, intervalSecs)
-		// Create unique aggregation key
-		key = RecordKey{
-			CampaignID:  field.CampaignID,
-			CreativeID:  field.CreativeID,
-			IntervalStr: intervalStr,
-			IntervalTs:  ts,
-		}
-	case "wins":
-		field := WinFields{}
-		if err := json.Unmarshal(msg, &field); err != nil {
-			logger.Error(fmt.Sprintf("JSON unmarshaling failed: %s", err))
-			return
-		}
-		ts, tsMs, tm = intervalTimestamp(field.Timestamp, intervalSecs)
-		key = RecordKey{
-			CampaignID:  field.CampaignID,
-			CreativeID:  field.CreativeID,
-			IntervalStr: intervalStr,
-			IntervalTs:  ts,
-		}
-	case "pixels":
-		field := PixelFields{}
-		if err := json.Unmarshal(msg, &field); err != nil {
-			logger.Error(fmt.Sprintf("JSON unmarshaling failed: %s", err))
-			return
-		}
-		ts, tsMs, tm = intervalTimestamp(field.Timestamp, intervalSecs)
-		key = RecordKey{
-			CampaignID:  field.CampaignID,
-			CreativeID:  field.CreativeID,
-			IntervalStr: intervalStr,
-			IntervalTs:  ts,
+	} else {
+		err = fmt.Errorf("Event from unsubscribed topic %s", ev.Topic)
+	}
+	if err != nil && !restored {
+		// Dead letter is sent before the offset can be acknowledged
+		rejectEvent(ev, err)
+	}
+	// Offset is acknowledged after its interval is written
+	offsetTracker.track(ev.Topic, ev.Partition, ev.Offset, intervals, err == nil, ev.Ack)
+	flushLock.RUnlock()
+}
+
+// Mark the event if it is a duplicate, otherwise join it to the earlier steps of its bid id
+// and add the cost of a win to its campaign's pacing
+func screenEvent(topic TopicBinding, field EventFields) EventFields {
+	if dedup.duplicate(topic.Kind, field) {
+		dupCounts.add(topic.Topic)
+		field.Duplicate = true
+		return field
+	}
+	if topic.Kind == KindWin {
+		pacing.addWin(field)
+	}
+	return funnelJoin.join(topic.Kind, field)
+}
+
+// Parse a message from a bids topic
+func parseBid(msg []byte) (EventFields, error) {
+	field := BidFields{}
+	if err := json.Unmarshal(msg, &field); err != nil {
+		return EventFields{}, err
+	}
+	return EventFields{
+		CampaignID: field.CampaignID,
+		CreativeID: field.CreativeID,
+		AdType:     field.AdType,
+		Domain:     field.Domain,
+		Exchange:   field.Exchange,
+		Price:      field.Cost,
+		Timestamp:  field.Timestamp,
+		BidID:      field.BidID,
+	}, nil
+}
+
+// Parse a message from a wins topic
+func parseWin(msg []byte) (EventFields, error) {
+	field := WinFields{}
+	if err := json.Unmarshal(msg, &field); err != nil {
+		return EventFields{}, err
+	}
+	return EventFields{
+		CampaignID: field.CampaignID,
+		CreativeID: field.CreativeID,
+		AdType:     field.AdType,
+		Domain:     field.Domain,
+		Exchange:   field.Exchange,
+		Price:      field.Price,
+		Cost:       field.Cost,
+		Timestamp:  field.Timestamp,
+		BidID:      field.BidID,
+	}, nil
+}
+
+// Parse a message from a pixels topic
+func parsePixel(msg []byte) (EventFields, error) {
+	field := PixelFields{}
+	if err := json.Unmarshal(msg, &field); err != nil {
+		return EventFields{}, err
+	}
+	return EventFields{
+		CampaignID: field.CampaignID,
+		CreativeID: field.CreativeID,
+		AdType:     field.AdType,
+		Domain:     field.Domain,
+		Exchange:   field.Exchange,
+		Timestamp:  field.Timestamp,
+		BidID:      field.BidID,
+	}, nil
+}
+
+// Parse a message from a clicks topic
+func parseClick(msg []byte) (EventFields, error) {
+	field := ClickFields{}
+	if err := json.Unmarshal(msg, &field); err != nil {
+		return EventFields{}, err
+	}
+	return EventFields{
+		CampaignID: field.CampaignID,
+		CreativeID: field.CreativeID,
+		AdType:     field.AdType,
+		Domain:     field.Domain,
+		Exchange:   field.Exchange,
+		Timestamp:  field.Timestamp,
+		BidID:      field.BidID,
+	}, nil
+}
+
+// Parse and check a message of the topic
+func parseEvent(topic TopicBinding, msg []byte) (EventFields, error) {
+	field, err := topic.parse(msg)
+	if err != nil {
+		return field, fmt.Errorf("JSON unmarshaling failed: %s", err)
+	}
+	if field.Timestamp <= 0 {
+		return field, errors.New("Missing timestamp")
+	}
+	return field, nil
+}
+
+// Count parsed event fields in every granularity, window and dimension set. Late events are counted or dropped by the late policy.
+// Returns the interval timestamp the event was counted in by granularity, -1 where it was dropped.
+func (agg *AggStore) addFields(kind EventKind, field EventFields) []int64 {
+	intervals := make([]int64, len(granularities))
+	for i, g := range granularities {
+		ts, tsMs, tm := intervalTimestamp(field.Timestamp, g.IntervalSecs)
+		late, counted := agg.lateInterval(g.IntervalStr, tsMs)
+		if !counted {
+			lateCounts.add(g.IntervalStr + " dropped")
+			intervals[i] = -1
+			continue
 		}
-	case "clicks":
-		field := ClickFields{}
-		if err := json.Unmarshal(msg, &field); err != nil {
-			logger.Error(fmt.Sprintf("JSON unmarshaling failed: %s", err))
-			return
+		if late {
+			lateCounts.add(g.IntervalStr + " corrected")
 		}
-		ts, tsMs, tm = intervalTimestamp(field.Timestamp, intervalSecs)
-		key = RecordKey{
-			CampaignID:  field.CampaignID,
-			CreativeID:  field.CreativeID,
-			IntervalStr: intervalStr,
-			IntervalTs:  ts,
+		// Create unique aggregation key for each dimension set
+		for _, d := range dimensionSets {
+			agg.add(kind, d.key(field, g.IntervalStr, ts), field, tsMs, tm, late)
 		}
-	default:
-		log1.Alert(fmt.Sprintf("Unexpected topic %s.", topic))
-		return
-
+		intervals[i] = tsMs
 	}
-	// Check if agg record already exists for this camp/creat/interval
-	_, ok := agg[key]
-	if !ok {
-		// Doesn't exists so initialize
-		agg[key] = CountFields{new(sync.Mutex), 0, tsMs, tm}
+	for _, w := range windowStores {
+		w.add(kind, field)
 	}
-	agg[key].lock.Lock() // mutex lock
-	tmp := agg[key]      // increment count
-	tmp.count++
-	agg[key] = tmp
-	agg[key].lock.Unlock() // mutex unlock
-
+	return intervals
 }
 
 // Compute interval timestamp - string and epoch milliseconds
@@ -194,17 +276,3 @@ func intervalTimestamp(timestamp int64, interval int64) (string, int64, time.Tim
 	log1.Debug(fmt.Sprintf("Interval Time stamp string: %s, %d", str, epochms))
 	return str, epochms, tm
 }
-
-// Lock counter entry
-func (agg OutputCounts) Lock(key RecordKey) {
-	if _, found := agg[key]; found {
-		agg[key].lock.Lock()
-	}
-}
-
-// Unlock counter entry
-func (agg OutputCounts) Unlock(key RecordKey) {
-	if _, found := agg[key]; found {
-		agg[key].lock.Unlock()
-	}
-}
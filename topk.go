@@ -0,0 +1,226 @@
+//
+//  Heavy hitters - the top domains and exchanges of a record by wins and by spend.
+//  Uses the Space-Saving algorithm: a fixed number of counters, the smallest is taken over
+//  by a new item, which inherits its count as the error bound. Any item with more than
+//  1/capacity of the total is always kept, so a single site draining budget shows up.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+)
+
+// Counters kept per top N item. More counters make the counts of the top items more exact.
+const topKCounters = 4
+
+// Number of top items written per record, 0 for none
+var topN = 5
+
+// HeavyHitter - a top item and its count. The count overestimates by at most MaxError.
+type HeavyHitter struct {
+	Name     string `json:"name"`
+	Count    int64  `json:"count"`
+	MaxError int64  `json:"maxError,omitempty"`
+}
+
+// hitterCounter - count of one monitored item
+type hitterCounter struct {
+	count int64
+	err   int64
+}
+
+// TopK - Space-Saving summary of weighted items
+type TopK struct {
+	capacity int
+	counters map[string]*hitterCounter
+}
+
+func newTopK(n int) *TopK {
+	return &TopK{capacity: n * topKCounters, counters: make(map[string]*hitterCounter)}
+}
+
+// Add a weight to an item. If all counters are used the smallest is taken over.
+func (t *TopK) Add(item string, weight int64) {
+	if c, found := t.counters[item]; found {
+		c.count += weight
+		return
+	}
+	if len(t.counters) < t.capacity {
+		t.counters[item] = &hitterCounter{count: weight}
+		return
+	}
+	minItem, min := t.min()
+	delete(t.counters, minItem)
+	t.counters[item] = &hitterCounter{count: min.count + weight, err: min.count}
+}
+
+// The item with the smallest count, ties broken by name so the result doesn't depend on map order
+func (t *TopK) min() (string, *hitterCounter) {
+	var minItem string
+	var min *hitterCounter
+	for item, c := range t.counters {
+		if min == nil || c.count < min.count || (c.count == min.count && item < minItem) {
+			minItem, min = item, c
+		}
+	}
+	return minItem, min
+}
+
+// Merge another summary into this one. Items missing from a full summary may have
+// had up to its smallest count, which is added to their count and error.
+func (t *TopK) Merge(o *TopK) {
+	var tMin, oMin int64
+	if len(t.counters) >= t.capacity {
+		_, c := t.min()
+		tMin = c.count
+	}
+	if len(o.counters) >= o.capacity {
+		_, c := o.min()
+		oMin = c.count
+	}
+	for item, c := range t.counters {
+		if _, found := o.counters[item]; !found {
+			c.count += oMin
+			c.err += oMin
+		}
+	}
+	for item, oc := range o.counters {
+		if c, found := t.counters[item]; found {
+			c.count += oc.count
+			c.err += oc.err
+		} else {
+			t.counters[item] = &hitterCounter{count: oc.count + tMin, err: oc.err + tMin}
+		}
+	}
+	for len(t.counters) > t.capacity {
+		item, _ := t.min()
+		delete(t.counters, item)
+	}
+}
+
+// Copy of the summary
+func (t *TopK) clone() *TopK {
+	if t == nil {
+		return nil
+	}
+	c := &TopK{capacity: t.capacity, counters: make(map[string]*hitterCounter, len(t.counters))}
+	for item, hc := range t.counters {
+		c.counters[item] = &hitterCounter{count: hc.count, err: hc.err}
+	}
+	return c
+}
+
+// The n items with the highest counts, highest first
+func (t *TopK) Top(n int) []HeavyHitter {
+	if t == nil || n <= 0 {
+		return nil
+	}
+	hitters := make([]HeavyHitter, 0, len(t.counters))
+	for item, c := range t.counters {
+		hitters = append(hitters, HeavyHitter{Name: item, Count: c.count, MaxError: c.err})
+	}
+	sort.Slice(hitters, func(i, j int) bool {
+		if hitters[i].Count != hitters[j].Count {
+			return hitters[i].Count > hitters[j].Count
+		}
+		return hitters[i].Name < hitters[j].Name
+	})
+	if len(hitters) > n {
+		hitters = hitters[:n]
+	}
+	return hitters
+}
+
+// topKSnapshot - exported form of the summary, for checkpoints
+type topKSnapshot struct {
+	Capacity int
+	Items    []string
+	Counts   []int64
+	Errors   []int64
+}
+
+// GobEncode encodes the summary for a checkpoint
+func (t *TopK) GobEncode() ([]byte, error) {
+	snap := topKSnapshot{Capacity: t.capacity}
+	for item, c := range t.counters {
+		snap.Items = append(snap.Items, item)
+		snap.Counts = append(snap.Counts, c.count)
+		snap.Errors = append(snap.Errors, c.err)
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(snap)
+	return buf.Bytes(), err
+}
+
+// GobDecode decodes a summary encoded by GobEncode
+func (t *TopK) GobDecode(b []byte) error {
+	snap := topKSnapshot{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&snap); err != nil {
+		return err
+	}
+	t.capacity = snap.Capacity
+	t.counters = make(map[string]*hitterCounter, len(snap.Items))
+	for i, item := range snap.Items {
+		t.counters[item] = &hitterCounter{count: snap.Counts[i], err: snap.Errors[i]}
+	}
+	return nil
+}
+
+// Merge a summary into another that may not have been created yet. Returns the merged summary.
+func mergeTopK(t *TopK, o *TopK) *TopK {
+	if o == nil {
+		return t
+	}
+	if t == nil {
+		return o.clone()
+	}
+	t.Merge(o)
+	return t
+}
+
+// heavyHitters - top domains and exchanges of a record's wins
+type heavyHitters struct {
+	domainWins    *TopK
+	domainSpend   *TopK // Win cost in micro units
+	exchangeWins  *TopK
+	exchangeSpend *TopK // Win cost in micro units
+}
+
+func newHeavyHitters(n int) *heavyHitters {
+	return &heavyHitters{
+		domainWins:    newTopK(n),
+		domainSpend:   newTopK(n),
+		exchangeWins:  newTopK(n),
+		exchangeSpend: newTopK(n),
+	}
+}
+
+// Add a win
+func (h *heavyHitters) addWin(field EventFields) {
+	if field.Domain != "" {
+		h.domainWins.Add(field.Domain, 1)
+		h.domainSpend.Add(field.Domain, int64(field.Cost))
+	}
+	if field.Exchange != "" {
+		h.exchangeWins.Add(field.Exchange, 1)
+		h.exchangeSpend.Add(field.Exchange, int64(field.Cost))
+	}
+}
+
+// Merge heavy hitters into others that may not have been created yet. Returns the merged heavy hitters.
+func mergeHeavyHitters(h *heavyHitters, o *heavyHitters) *heavyHitters {
+	if o == nil {
+		return h
+	}
+	if h == nil {
+		h = &heavyHitters{}
+	}
+	h.domainWins = mergeTopK(h.domainWins, o.domainWins)
+	h.domainSpend = mergeTopK(h.domainSpend, o.domainSpend)
+	h.exchangeWins = mergeTopK(h.exchangeWins, o.exchangeWins)
+	h.exchangeSpend = mergeTopK(h.exchangeSpend, o.exchangeSpend)
+	return h
+}
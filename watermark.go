@@ -0,0 +1,105 @@
+//
+//  Event time watermarks and the late data policy.
+//  The watermark of a partition is the latest event time counted from it. An interval is
+//  complete once the lowest partition watermark, less the allowed lateness, has passed its end.
+//  Partitions that have gone quiet don't hold the watermark back.
+//  Events for an interval that has already been written are late, and handled by the policy.
+//
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Late data policies
+const (
+	LateDrop   = "drop"   // Late events are not counted, only logged as dropped
+	LateDelta  = "delta"  // A correction record with the counts of the late events is written
+	LateReemit = "reemit" // The full record is written again, including the late events
+)
+
+// LateData - how long to wait for late events and what to do with those that come later
+type LateData struct {
+	Policy  string        // LateDrop, LateDelta or LateReemit
+	Allowed time.Duration // Event time to wait after an interval ends before it is written
+	Horizon time.Duration // How long after an interval is written late events still correct it
+}
+
+// partitionWatermark - event time progress of one partition
+type partitionWatermark struct {
+	eventMs int64     // Latest event time, epoch milliseconds
+	seen    time.Time // Wall clock of the latest event
+}
+
+// Watermarks - event time progress of all partitions
+type Watermarks struct {
+	lock       *sync.Mutex
+	partitions map[PartitionID]*partitionWatermark
+	idle       time.Duration // Partitions without events for this long are ignored
+	current    int64         // Last watermark returned, it never moves back
+}
+
+// Late data settings, drop after 30 seconds unless configured
+var lateData = LateData{Policy: LateDrop, Allowed: 30 * time.Second, Horizon: time.Hour}
+
+// Instantiate the watermarks
+var watermarks = newWatermarks(time.Minute)
+
+// Late events by granularity and what was done with them, since startup
+var lateCounts = newEventCounts("Late events")
+
+func newWatermarks(idle time.Duration) *Watermarks {
+	return &Watermarks{
+		lock:       new(sync.Mutex),
+		partitions: make(map[PartitionID]*partitionWatermark),
+		idle:       idle,
+	}
+}
+
+// Record the event time of an event counted from the partition
+func (w *Watermarks) observe(topic string, partition int32, eventMs int64, now time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	id := PartitionID{topic, partition}
+	p, ok := w.partitions[id]
+	if !ok {
+		p = &partitionWatermark{}
+		w.partitions[id] = p
+	}
+	if eventMs > p.eventMs {
+		p.eventMs = eventMs
+	}
+	p.seen = now
+}
+
+// The watermark, less the allowed lateness, in epoch milliseconds. It is the lowest event time of
+// the active partitions. If every partition is idle nothing more is coming, the wall clock is used.
+func (w *Watermarks) watermark(now time.Time) int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	lowest := int64(-1)
+	for _, p := range w.partitions {
+		if now.Sub(p.seen) > w.idle {
+			continue
+		}
+		if lowest < 0 || p.eventMs < lowest {
+			lowest = p.eventMs
+		}
+	}
+	if lowest < 0 {
+		lowest = timeMs(now)
+	}
+	if wm := lowest - int64(lateData.Allowed/time.Millisecond); wm > w.current {
+		w.current = wm
+	}
+	return w.current
+}
+
+// The latest interval of the granularity that is complete at the watermark, the collect time
+// for the intervals that can be written.
+func completeInterval(g Granularity, watermarkMs int64) int64 {
+	_, tsMs, _ := intervalTimestamp(watermarkMs, g.IntervalSecs) // Interval the watermark is in
+	return tsMs - g.IntervalSecs*1000
+}
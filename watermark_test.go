@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Records written for the interval starting at tsMs, in the order written
+func (w *testRecordWriter) interval(intervalStr string, tsMs int64) []AggCounter {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	records := []AggCounter{}
+	for _, rec := range w.records {
+		if rec.Interval == intervalStr && timeMs(rec.Timestamp) == tsMs {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// A late event for a written interval is dropped, written as a correction of the late events only,
+// or written again with the whole record, by the policy
+func TestLatePolicies(t *testing.T) {
+	defer func(l LateData) { lateData = l }(lateData)
+	tests := []struct {
+		policy string
+		bids   int64 // Bids of the record written for the late event, 0 for none
+	}{
+		{LateDrop, 0},
+		{LateDelta, 1},
+		{LateReemit, 4},
+	}
+	for _, test := range tests {
+		lateData = LateData{Policy: test.policy, Allowed: 30 * time.Second, Horizon: time.Hour}
+		w := resetPipeline("")
+		bindings := testBindings(t)
+		bid := func(offset int64, tsMs int64) {
+			countEvent(bindings, Event{Topic: "bids", Partition: 0, Offset: offset, Value: testBid(1, tsMs, fmt.Sprint(offset))})
+		}
+		for i := int64(0); i < 3; i++ {
+			bid(i, testBaseMs+i)
+		}
+		bid(3, testBaseMs+600000) // Completes the first interval
+		writeLastInterval(Granularity{"5m", 300})
+		bid(4, testBaseMs+5) // Late
+		bid(5, testBaseMs+900000)
+		writeLastInterval(Granularity{"5m", 300})
+
+		records := w.interval("5m", testBaseMs)
+		if len(records) == 0 || records[0].Bids != 3 || records[0].Correction != "" {
+			t.Fatalf("%s: first records %+v, want 3 bids", test.policy, records)
+		}
+		if test.bids == 0 {
+			if len(records) != 1 {
+				t.Fatalf("%s: records %+v, want the late bid dropped", test.policy, records)
+			}
+			continue
+		}
+		if len(records) != 2 || records[1].Bids != test.bids || records[1].Correction != test.policy {
+			t.Fatalf("%s: records %+v, want a %s correction of %d bids", test.policy, records, test.policy, test.bids)
+		}
+	}
+}
+
+// Late events are corrected up to the late horizon after the last interval written, then dropped
+func TestLateHorizon(t *testing.T) {
+	defer func(l LateData) { lateData = l }(lateData)
+	lateData = LateData{Policy: LateDelta, Allowed: 30 * time.Second, Horizon: 10 * time.Minute}
+	w := resetPipeline("")
+	bindings := testBindings(t)
+	bid := func(offset int64, tsMs int64) {
+		countEvent(bindings, Event{Topic: "bids", Partition: 0, Offset: offset, Value: testBid(1, tsMs, fmt.Sprint(offset))})
+	}
+	bid(0, testBaseMs)
+	bid(1, testBaseMs+300000)
+	bid(2, testBaseMs+1200000) // Completes the intervals to 10 minutes
+	writeLastInterval(Granularity{"5m", 300})
+	if written, _ := aggStore.writtenTo("5m"); written != testBaseMs+600000 {
+		t.Fatalf("Written to %d, want %d", written, testBaseMs+600000)
+	}
+
+	bid(3, testBaseMs+1)      // 10 minutes before the last interval written, past the horizon
+	bid(4, testBaseMs+300001) // Within the horizon
+	bid(5, testBaseMs+1800000)
+	writeLastInterval(Granularity{"5m", 300})
+	if records := w.interval("5m", testBaseMs); len(records) != 1 {
+		t.Fatalf("Records %+v past the horizon, want the late bid dropped", records)
+	}
+	records := w.interval("5m", testBaseMs+300000)
+	if len(records) != 2 || records[1].Bids != 1 || records[1].Correction != LateDelta {
+		t.Fatalf("Records %+v within the horizon, want a delta correction of 1 bid", records)
+	}
+}
+
+// Partitions without events for the idle timeout don't hold the watermark back. When all are
+// idle the wall clock is the watermark. It never moves back.
+func TestWatermarkIdle(t *testing.T) {
+	defer func(l LateData) { lateData = l }(lateData)
+	lateData = LateData{Policy: LateDrop, Allowed: 30 * time.Second, Horizon: time.Hour}
+	allowedMs := int64(30000)
+	w := newWatermarks(time.Minute)
+	now := time.Unix(0, (testBaseMs+3600000)*int64(time.Millisecond))
+	w.observe("bids", 0, testBaseMs+1000, now)
+	w.observe("bids", 1, testBaseMs+5000, now)
+	if wm := w.watermark(now); wm != testBaseMs+1000-allowedMs {
+		t.Fatalf("Watermark %d, want the lowest partition less the allowed lateness", wm-testBaseMs)
+	}
+
+	// Partition 0 has been idle for over a minute
+	w.observe("bids", 1, testBaseMs+8000, now.Add(90*time.Second))
+	if wm := w.watermark(now.Add(90 * time.Second)); wm != testBaseMs+8000-allowedMs {
+		t.Fatalf("Watermark %d, want partition 1 only", wm-testBaseMs)
+	}
+
+	// Every partition is idle
+	later := now.Add(10 * time.Minute)
+	if wm := w.watermark(later); wm != timeMs(later)-allowedMs {
+		t.Fatalf("Watermark %d, want the wall clock", wm-testBaseMs)
+	}
+	w.observe("bids", 0, testBaseMs+2000, later)
+	if wm := w.watermark(later); wm != timeMs(later)-allowedMs {
+		t.Fatalf("Watermark moved back to %d", wm-testBaseMs)
+	}
+}
@@ -0,0 +1,207 @@
+//
+//  Sliding and hopping windows for live views, ie the last 15 minutes updated every minute.
+//  A window is counted in sub-buckets of its hop, kept per record key in a ring sized to the
+//  window plus the allowed lateness, so memory per key is fixed however often it is written.
+//  Each time the watermark passes a hop the buckets of the window ending there are summed and
+//  written as records with the window as the interval, ie 15m/1m. A sliding window is a
+//  hopping window that hops every --windowSlide.
+//  Windows are a view of the counts only: they are not checkpointed, hold back no offsets and
+//  partial windows are not written on shutdown.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Window - a sliding or hopping window
+type Window struct {
+	Name     string // Size and hop, ie 15m/1m. Set in RecordKey.IntervalStr
+	SizeSecs int64
+	HopSecs  int64 // Time between the windows written, and the size of the sub-buckets
+}
+
+// windowBucket - counters of one hop of a record key
+type windowBucket struct {
+	startMs  int64 // Start of the hop, epoch milliseconds. 0 if unused.
+	counts   [numEventKinds]int64
+	bidPrice Micros
+	winPrice Micros
+	winCost  Micros
+}
+
+// WindowStore - sub-buckets of the record keys of a window
+type WindowStore struct {
+	lock      *sync.Mutex
+	window    Window
+	slots     int                          // Buckets in each ring
+	rings     map[RecordKey][]windowBucket // Key without the interval timestamp to its buckets
+	writtenMs int64                        // End of the latest window written, epoch milliseconds
+}
+
+// Windows written, none unless configured
+var windowStores = []*WindowStore{}
+
+func newWindowStore(w Window, lateness time.Duration) *WindowStore {
+	hopMs := w.HopSecs * 1000
+	lateSlots := (int64(lateness/time.Millisecond) + hopMs - 1) / hopMs
+	return &WindowStore{
+		lock:   new(sync.Mutex),
+		window: w,
+		slots:  int(w.SizeSecs/w.HopSecs + lateSlots + 1),
+		rings:  make(map[RecordKey][]windowBucket),
+	}
+}
+
+// Parse the windows, ie 15m/1m for hopping windows or 15m for sliding windows that hop every slide.
+// The hop must divide the size, and a day, so windows end at the same times each day.
+func parseWindows(specs []string, slide string) ([]Window, error) {
+	result := []Window{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.Split(spec, "/")
+		if len(parts) == 1 {
+			parts = append(parts, slide)
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Bad window %q, expected <size> or <size>/<hop>", spec)
+		}
+		w := Window{Name: strings.TrimSpace(parts[0]) + "/" + strings.TrimSpace(parts[1])}
+		var err error
+		if w.SizeSecs, err = parseIntervalSecs(strings.TrimSpace(parts[0])); err != nil {
+			return nil, fmt.Errorf("Window %q: %s", spec, err)
+		}
+		if w.HopSecs, err = parseIntervalSecs(strings.TrimSpace(parts[1])); err != nil {
+			return nil, fmt.Errorf("Window %q: %s", spec, err)
+		}
+		if w.SizeSecs%w.HopSecs != 0 {
+			return nil, fmt.Errorf("Window %q size is not a multiple of its hop", spec)
+		}
+		for _, o := range result {
+			if o.Name == w.Name {
+				return nil, fmt.Errorf("Window %q is configured twice", spec)
+			}
+		}
+		result = append(result, w)
+	}
+	return result, nil
+}
+
+// Add an event to the bucket of its hop in every dimension set. Events too old for any window
+// still to be written are dropped.
+func (s *WindowStore) add(kind EventKind, field EventFields) {
+	if field.Duplicate {
+		return
+	}
+	hopMs := s.window.HopSecs * 1000
+	startMs := field.Timestamp - field.Timestamp%hopMs
+	slot := int(startMs/hopMs) % s.slots
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if startMs+s.window.SizeSecs*1000 <= s.writtenMs {
+		lateCounts.add(s.window.Name + " dropped")
+		return
+	}
+	for _, d := range dimensionSets {
+		key := d.key(field, s.window.Name, "")
+		ring, found := s.rings[key]
+		if !found {
+			ring = make([]windowBucket, s.slots)
+			s.rings[key] = ring
+		}
+		b := &ring[slot]
+		if b.startMs > startMs {
+			// The slot has moved on to a later hop
+			lateCounts.add(s.window.Name + " dropped")
+			continue
+		}
+		if b.startMs < startMs {
+			*b = windowBucket{startMs: startMs}
+		}
+		b.counts[kind]++
+		switch kind {
+		case KindBid:
+			b.bidPrice += field.Price
+		case KindWin:
+			b.winPrice += field.Price
+			b.winCost += field.Cost
+		}
+	}
+}
+
+// Sum the buckets of the windows ending since the last written, up to the watermark.
+// Only the latest window is collected the first time. Keys with nothing left in the ring are dropped.
+func (s *WindowStore) collect(watermarkMs int64) map[RecordKey]CountFields {
+	hopMs := s.window.HopSecs * 1000
+	sizeMs := s.window.SizeSecs * 1000
+	endMs := watermarkMs - watermarkMs%hopMs
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if endMs <= s.writtenMs {
+		return nil
+	}
+	firstMs := endMs
+	if s.writtenMs > 0 {
+		firstMs = s.writtenMs + hopMs
+		if firstMs < endMs-sizeMs+hopMs {
+			firstMs = endMs - sizeMs + hopMs // Older windows are no longer whole in the rings
+		}
+	}
+	records := make(map[RecordKey]CountFields)
+	for key, ring := range s.rings {
+		for wEndMs := firstMs; wEndMs <= endMs; wEndMs += hopMs {
+			if fields, found := sumBuckets(ring, wEndMs-sizeMs, wEndMs); found {
+				tm := time.Unix((wEndMs-sizeMs)/1000, 0)
+				fields.intervalTs, fields.intervalTm = wEndMs-sizeMs, tm
+				recKey := key
+				recKey.IntervalTs = tm.UTC().Format(time.RFC3339)
+				records[recKey] = fields
+			}
+		}
+		live := false
+		for _, b := range ring {
+			if b.startMs+sizeMs > endMs {
+				live = true
+				break
+			}
+		}
+		if !live {
+			delete(s.rings, key)
+		}
+	}
+	s.writtenMs = endMs
+	return records
+}
+
+// Counters of the buckets from startMs to endMs. False if there are none.
+func sumBuckets(ring []windowBucket, startMs int64, endMs int64) (CountFields, bool) {
+	fields := CountFields{}
+	found := false
+	for _, b := range ring {
+		if b.startMs < startMs || b.startMs >= endMs {
+			continue
+		}
+		found = true
+		for kind, n := range b.counts {
+			fields.counts[kind] += n
+		}
+		fields.bidPrice += b.bidPrice
+		fields.winPrice += b.winPrice
+		fields.winCost += b.winCost
+	}
+	return fields, found
+}
+
+// Write the windows of the store that ended by the watermark
+func writeWindows(s *WindowStore, watermarkMs int64, now time.Time) {
+	if records := s.collect(watermarkMs); len(records) > 0 {
+		writeAggregatedRecords(records, now)
+	}
+}
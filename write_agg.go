@@ -8,6 +8,8 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
 	"time"
 )
 
@@ -15,8 +17,12 @@ import (
 // AggCounter - Counts aggregation record format. set as JSON.
 //
 type AggCounter struct {
+	Dimensions  string    `json:"dimensions"`
 	CampaignID  int64     `json:"campaignId"`
 	CreativeID  int64     `json:"creativeId"`
+	Exchange    string    `json:"exchange,omitempty"`
+	Domain      string    `json:"domain,omitempty"`
+	AdType      string    `json:"adtype,omitempty"`
 	Interval    string    `json:"interval"`
 	Region      string    `json:"region"`
 	Timestamp   time.Time `json:"timestamp"`
@@ -25,64 +31,208 @@ type AggCounter struct {
 	Wins        int64     `json:"wins"`
 	Pixels      int64     `json:"pixels"`
 	Clicks      int64     `json:"clicks"`
+	Correction  string    `json:"correction,omitempty"` // Late policy of a record correcting one already written
+
+	// Creative type, banner or video, from the ad type of the events or the campaign records.
+	// Empty if neither has it.
+	CreativeType string `json:"creativeType,omitempty"`
+
+	// Campaign and creative attributes selected by --attributes
+	CampaignName     string `json:"campaignName,omitempty"`
+	AdDomain         string `json:"adDomain,omitempty"`
+	CampaignStatus   string `json:"campaignStatus,omitempty"`
+	CampaignStart    string `json:"campaignStart,omitempty"` // RFC3339
+	CampaignEnd      string `json:"campaignEnd,omitempty"`
+	CreativeName     string `json:"creativeName,omitempty"`
+	Width            int64  `json:"width,omitempty"`
+	Height           int64  `json:"height,omitempty"`
+	VideoDuration    int64  `json:"videoDuration,omitempty"`          // Seconds
+	CreativeBidPrice Micros `json:"creativeBidPriceMicros,omitempty"` // Bid CPM of the creative
+
+	// Duplicate events suppressed by the dedup stage, not in the counts above
+	DuplicateBids   int64 `json:"duplicateBids,omitempty"`
+	DuplicateWins   int64 `json:"duplicateWins,omitempty"`
+	DuplicatePixels int64 `json:"duplicatePixels,omitempty"`
+	DuplicateClicks int64 `json:"duplicateClicks,omitempty"`
+
+	// Amounts in micro units
+	BidPrice         Micros `json:"bidPriceMicros"`         // Sum of the bid prices
+	WinPrice         Micros `json:"winPriceMicros"`         // Sum of the win clearing prices
+	WinCost          Micros `json:"winCostMicros"`          // Sum of the win costs
+	CPM              Micros `json:"cpmMicros"`              // Win cost per thousand wins
+	ECPC             Micros `json:"ecpcMicros"`             // Win cost per click
+	AvgClearingPrice Micros `json:"avgClearingPriceMicros"` // Win clearing price per win
+
+	// Approximate distinct domains, with the sketches to merge them across consumers or intervals
+	BidDomains      int64 `json:"distinctBidDomains"`
+	WinDomains      int64 `json:"distinctWinDomains"`
+	BidDomainSketch *HLL  `json:"bidDomainSketch,omitempty"`
+	WinDomainSketch *HLL  `json:"winDomainSketch,omitempty"`
+
+	// Top domains and exchanges of the wins. Spend counts are win costs in micro units.
+	TopDomainsByWins    []HeavyHitter `json:"topDomainsByWins,omitempty"`
+	TopDomainsBySpend   []HeavyHitter `json:"topDomainsBySpend,omitempty"`
+	TopExchangesByWins  []HeavyHitter `json:"topExchangesByWins,omitempty"`
+	TopExchangesBySpend []HeavyHitter `json:"topExchangesBySpend,omitempty"`
+
+	// Funnel of the events joined by bid id
+	WinsJoined        int64           `json:"winsJoined"`   // Wins whose bid was seen
+	PixelsJoined      int64           `json:"pixelsJoined"` // Pixels whose win was seen
+	ClicksJoined      int64           `json:"clicksJoined"` // Clicks whose pixel was seen
+	WinPixelRate      float64         `json:"winPixelRate"`
+	PixelClickRate    float64         `json:"pixelClickRate"`
+	BidWinLatency     *LatencySummary `json:"bidWinLatency,omitempty"`
+	WinPixelLatency   *LatencySummary `json:"winPixelLatency,omitempty"`
+	PixelClickLatency *LatencySummary `json:"pixelClickLatency,omitempty"`
+}
+
+// RecordWriter - destination of the aggregation records
+type RecordWriter interface {
+	WriteRecord(aggrec AggCounter) error
+}
+
+// logRecordWriter - writes the aggregation records to the log
+type logRecordWriter struct{}
+
+// jsonRecordWriter - writes the aggregation records as newline delimited JSON
+type jsonRecordWriter struct {
+	enc *json.Encoder
+}
+
+// Where the aggregation records are written. Logged by default.
+var recordWriter RecordWriter = logRecordWriter{}
+
+// Write the distinct domain sketches in the records, off by default
+var writeSketches = false
+
+// WriteRecord logs the record as JSON
+func (w logRecordWriter) WriteRecord(aggrec AggCounter) error {
+	log1 := logger.GetLogger("writeAggregatedRecords")
+	jsonStr, err := json.Marshal(aggrec)
+	if err != nil {
+		return err
+	}
+	log1.Info(fmt.Sprintf("Agg record %s", jsonStr))
+	return nil
+}
+
+func newJSONRecordWriter(w io.Writer) *jsonRecordWriter {
+	return &jsonRecordWriter{enc: json.NewEncoder(w)}
+}
+
+// WriteRecord writes the record as one line of JSON
+func (w *jsonRecordWriter) WriteRecord(aggrec AggCounter) error {
+	return w.enc.Encode(aggrec)
 }
 
 //
-// Print the aggregation record for the last interval
+// Print the aggregation record for the last interval.
+// Records are written in interval, dimension set, then dimension order. now is the DbTimestamp of the records.
 //
-func writeAggregatedRecords(allkeys *map[RecordKey]struct{}) {
+func writeAggregatedRecords(records map[RecordKey]CountFields, now time.Time) {
 	log1 := logger.GetLogger("writeAggregatedRecords")
-	for k := range *allkeys {
+	keys := make([]RecordKey, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	written := make([]AggCounter, 0, len(keys))
+	for _, k := range keys {
+		fields := records[k]
 		log1.Debug(fmt.Sprintf("Writing entry key %v:", k))
-		// Lock this recordkey's counters
-		aggBids.Lock(k)
-		aggWins.Lock(k)
-		aggClicks.Lock(k)
-		aggPixels.Lock(k)
-
 		campaignID := k.CampaignID
 		creativeID := k.CreativeID
 		intervalStr := k.IntervalStr
-		campaignRec := findCampaign(campaignID, creativeID)
-		var intervalTime time.Time
-		if aggBids[k].count > 0 {
-			intervalTime = aggBids[k].intervalTm
-		} else if aggWins[k].count > 0 {
-			intervalTime = aggWins[k].intervalTm
-		} else if aggPixels[k].count > 0 {
-			intervalTime = aggPixels[k].intervalTm
-		} else if aggClicks[k].count > 0 {
-			intervalTime = aggClicks[k].intervalTm
-		} else {
-			intervalTime = time.Now()
-		}
+		campaignRec := findCampaign(campaignID, creativeID, k.Creative)
 		// Create a aggregation record in JSON
-		now := time.Now().UTC()
 		aggrec := AggCounter{
+			Dimensions:  k.Dimensions,
 			CampaignID:  campaignID,
 			CreativeID:  creativeID,
+			Exchange:    k.Exchange,
+			Domain:      k.Domain,
+			AdType:      k.AdType,
 			Interval:    intervalStr,
 			Region:      campaignRec.Regions.String,
-			Timestamp:   intervalTime,
+			Timestamp:   fields.intervalTm,
 			DbTimestamp: now,
-			Bids:        aggBids[k].count,
-			Wins:        aggWins[k].count,
-			Pixels:      aggPixels[k].count,
-			Clicks:      aggClicks[k].count,
+			Bids:        fields.counts[KindBid],
+			Wins:        fields.counts[KindWin],
+			Pixels:      fields.counts[KindPixel],
+			Clicks:      fields.counts[KindClick],
+			BidPrice:    fields.bidPrice,
+			WinPrice:    fields.winPrice,
+			WinCost:     fields.winCost,
+		}
+		aggrec.CreativeType = k.Creative
+		if campaignRec.Type != "" {
+			aggrec.CreativeType = campaignRec.Type
+		}
+		aggrec.setAttributes(campaignRec)
+		aggrec.DuplicateBids = fields.dups[KindBid]
+		aggrec.DuplicateWins = fields.dups[KindWin]
+		aggrec.DuplicatePixels = fields.dups[KindPixel]
+		aggrec.DuplicateClicks = fields.dups[KindClick]
+		aggrec.CPM = fields.winCost.per(aggrec.Wins, 1000)
+		aggrec.ECPC = fields.winCost.per(aggrec.Clicks, 1)
+		aggrec.AvgClearingPrice = fields.winPrice.per(aggrec.Wins, 1)
+		aggrec.BidDomains = fields.bidDomains.Estimate()
+		aggrec.WinDomains = fields.winDomains.Estimate()
+		if h := fields.hitters; h != nil {
+			aggrec.TopDomainsByWins = h.domainWins.Top(topN)
+			aggrec.TopDomainsBySpend = h.domainSpend.Top(topN)
+			aggrec.TopExchangesByWins = h.exchangeWins.Top(topN)
+			aggrec.TopExchangesBySpend = h.exchangeSpend.Top(topN)
+		}
+		aggrec.WinsJoined = fields.joined[KindWin]
+		aggrec.PixelsJoined = fields.joined[KindPixel]
+		aggrec.ClicksJoined = fields.joined[KindClick]
+		aggrec.WinPixelRate = rate(aggrec.PixelsJoined, aggrec.Wins)
+		aggrec.PixelClickRate = rate(aggrec.ClicksJoined, aggrec.Pixels)
+		aggrec.BidWinLatency = fields.latency[KindWin].summary()
+		aggrec.WinPixelLatency = fields.latency[KindPixel].summary()
+		aggrec.PixelClickLatency = fields.latency[KindClick].summary()
+		if writeSketches {
+			aggrec.BidDomainSketch = fields.bidDomains
+			aggrec.WinDomainSketch = fields.winDomains
+		}
+		if fields.late {
+			aggrec.Correction = lateData.Policy
+		}
+		if err := recordWriter.WriteRecord(aggrec); err != nil {
+			log1.Error(fmt.Sprintf("Error writing record %v: %s", k, err))
 		}
-		jsonStr, _ := json.Marshal(aggrec)
-		log1.Info(fmt.Sprintf("Agg record %s", jsonStr))
-
-		// Delete the counter object for this recordkey since we've written it
-		delete(aggBids, k)
-		delete(aggWins, k)
-		delete(aggPixels, k)
-		delete(aggClicks, k)
-		// Unlock counters
-		aggBids.Unlock(k)
-		aggWins.Unlock(k)
-		aggClicks.Unlock(k)
-		aggPixels.Unlock(k)
+		written = append(written, aggrec)
 	}
+	anomalies.observe(written)
 	return
 }
+
+// Order of the record keys when writing
+func (k RecordKey) less(o RecordKey) bool {
+	if k.IntervalTs != o.IntervalTs {
+		return k.IntervalTs < o.IntervalTs
+	}
+	if k.IntervalStr != o.IntervalStr {
+		return k.IntervalStr < o.IntervalStr
+	}
+	if k.Dimensions != o.Dimensions {
+		return k.Dimensions < o.Dimensions
+	}
+	if k.CampaignID != o.CampaignID {
+		return k.CampaignID < o.CampaignID
+	}
+	if k.CreativeID != o.CreativeID {
+		return k.CreativeID < o.CreativeID
+	}
+	if k.Creative != o.Creative {
+		return k.Creative < o.Creative
+	}
+	if k.Exchange != o.Exchange {
+		return k.Exchange < o.Exchange
+	}
+	if k.Domain != o.Domain {
+		return k.Domain < o.Domain
+	}
+	return k.AdType < o.AdType
+}